@@ -5,12 +5,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"fmt"
-	"os"
-
-	"gopkg.in/mgo.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 // dbBind represents a bind stored in the database.
@@ -19,82 +24,441 @@ type dbBind struct {
 	User     string `bson:",omitempty"`
 	AppHost  string `bson:",omitempty"`
 	Password string `bson:",omitempty"`
+	// CertSerial is the serial number of the client certificate issued to
+	// the app, in clusters that use x.509.
+	CertSerial string `bson:",omitempty"`
+	// Kind is readBind for read-only binds, and empty for the others.
+	Kind string `bson:",omitempty"`
+	// EnvPrefix is prepended to the names of the env variables of the bind.
+	EnvPrefix string `bson:",omitempty"`
+}
+
+// bindOptions holds the parameters given to bind-app.
+type bindOptions struct {
+	Kind      string
+	EnvPrefix string
+}
+
+// Kinds of bind, given in the access parameter of bind-app.
+const (
+	readWriteBind = ""
+	readBind      = "read"
+)
+
+// readEnvPrefix replaces the MONGODB_ prefix of the env of read-only binds,
+// so they don't clash with a read-write bind of the same app.
+const readEnvPrefix = "MONGODB_READ_"
+
+var envPrefixRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var (
+	errAmbiguousBind = &httpError{code: http.StatusBadRequest, kind: "ambiguous-bind", body: "The app has more than one bind, access is required"}
+	errBindNotFound  = &httpError{code: http.StatusNotFound, kind: "bind-not-found", body: "Bind not found"}
+	errAlreadyBound  = &httpError{code: http.StatusConflict, kind: "already-bound", body: "The app is already bound to the instance with this access"}
+)
+
+// envName returns the name of the given variable, like MONGODB_USER, in the
+// env of the bind.
+func (b dbBind) envName(key string) string {
+	if b.Kind == readBind {
+		key = readEnvPrefix + strings.TrimPrefix(key, "MONGODB_")
+	}
+	if b.EnvPrefix != "" {
+		key = b.EnvPrefix + "_" + key
+	}
+	return key
+}
+
+// bindRole returns the role granted to users of the given kind of bind.
+func bindRole(kind string) string {
+	if kind == readBind {
+		return "read"
+	}
+	return "readWrite"
 }
 
 type env map[string]string
 
 var locker = multiLocker()
 
-func bind(name, appHost string) (env, error) {
+var (
+	// heldLocks are the names locked in the store by this process.
+	heldLocks = make(map[string]bool)
+	heldMut   sync.Mutex
+)
+
+// lockTimeout is the maximum amount of time to wait for the lock of an
+// instance held by another process.
+const lockTimeout = 30 * time.Second
+
+var errLockTimeout = &httpError{code: http.StatusConflict, kind: "instance-busy", body: "Timed out waiting for the instance lock"}
+
+// lock acquires the lock of the given instance, both in this process and in
+// the store, so concurrent operations in other processes are also serialized.
+// It gives up waiting when ctx is done.
+func lock(ctx context.Context, name string) error {
 	locker.Lock(name)
-	defer locker.Unlock(name)
-	bind, err := newBind(name, appHost)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		acquired, err := getStore().Lock(ctx, name)
+		if err != nil {
+			locker.Unlock(name)
+			return err
+		}
+		if acquired {
+			heldMut.Lock()
+			heldLocks[name] = true
+			heldMut.Unlock()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			locker.Unlock(name)
+			return errLockTimeout
+		}
+		select {
+		case <-ctx.Done():
+			locker.Unlock(name)
+			return opError(ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// unlock releases the lock acquired by lock with the given ctx, using the
+// same config.
+func unlock(ctx context.Context, name string) {
+	heldMut.Lock()
+	delete(heldLocks, name)
+	heldMut.Unlock()
+	// the lock is released even when the operation was canceled.
+	if err := getStore().Unlock(context.WithoutCancel(ctx), name); err != nil {
+		log.Printf("failed to release the lock of %q: %s", name, err)
+	}
+	locker.Unlock(name)
+}
+
+// releaseLocks releases the locks held in the store by this process, so
+// operations interrupted by a shutdown don't block other processes until the
+// locks expire.
+func releaseLocks() {
+	heldMut.Lock()
+	defer heldMut.Unlock()
+	for name := range heldLocks {
+		if err := getStore().Unlock(context.Background(), name); err != nil {
+			log.Printf("failed to release the lock of %q: %s", name, err)
+		}
+		delete(heldLocks, name)
+	}
+}
+
+func bind(ctx context.Context, name, appHost string, opts bindOptions) (env, error) {
+	if reservedName(ctx, name) {
+		return nil, errReservedName
+	}
+	if err := lock(ctx, name); err != nil {
+		return nil, err
+	}
+	defer unlock(ctx, name)
+	instance, plan, cluster, err := getInstance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getStore().GetBind(ctx, name, appHost, opts.Kind); err == nil {
+		return nil, errAlreadyBound
+	} else if err != errNotFound {
+		return nil, err
+	}
+	return bindEnv(ctx, instance, plan, cluster, appHost, opts, nil)
+}
+
+// bindEnv creates a bind of the given instance, replacing the old one when
+// it isn't nil, and returns its env. The caller must hold the instance lock.
+func bindEnv(ctx context.Context, instance dbInstance, plan planConfig, cluster clusterConfig, appHost string, opts bindOptions, old *dbBind) (env, error) {
+	db := instance.database()
+	topo, err := clusterTopology(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	var ca []byte
+	if cluster.TLS.CAFile != "" {
+		if ca, err = ioutil.ReadFile(cluster.TLS.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		bind dbBind
+		cert issuedCert
+	)
+	if cluster.X509.enabled() {
+		bind, cert, err = newCertBind(ctx, cluster, instance, appHost, opts, old)
+	} else {
+		bind, err = newBind(ctx, cluster, instance, appHost, opts, old)
+	}
 	if err != nil {
 		return nil, err
 	}
-	hosts := coalesceEnv("MONGODB_PUBLIC_URI", "MONGODB_URI", "127.0.0.1:27017")
+	conn := connString{Username: bind.User, Password: bind.Password, Database: db}
+	conn.setHosts(strings.Join(topo.Hosts, ","))
 	data := map[string]string{
-		"MONGODB_HOSTS":         hosts,
+		"MONGODB_HOSTS":         strings.Join(conn.Hosts, ","),
 		"MONGODB_USER":          bind.User,
-		"MONGODB_PASSWORD":      bind.Password,
-		"MONGODB_DATABASE_NAME": name,
+		"MONGODB_DATABASE_NAME": db,
+	}
+	// the seedlist only has SRV and TXT records, so apps that connect to
+	// MONGODB_HOSTS keep getting the hosts.
+	if cluster.Seedlist != "" {
+		conn.SRV, conn.Hosts = true, []string{cluster.Seedlist}
 	}
-	var connStringSuffix string
-	if rs := os.Getenv("MONGODB_REPLICA_SET"); rs != "" {
+	if rs := topo.ReplicaSet; rs != "" {
 		data["MONGODB_REPLICA_SET"] = rs
-		connStringSuffix = "?replicaSet=" + rs
+		conn.set("replicaSet", rs)
 	}
-	data["MONGODB_CONNECTION_STRING"] = fmt.Sprintf(
-		"mongodb://%s:%s@%s/%s%s",
-		bind.User, bind.Password, hosts, name, connStringSuffix,
-	)
-	return env(data), nil
+	if !cluster.TLS.Enabled && conn.SRV {
+		// drivers enable TLS by default with mongodb+srv://.
+		conn.set("tls", "false")
+	}
+	if cluster.TLS.Enabled {
+		conn.set("tls", "true")
+		if cluster.TLS.Insecure {
+			conn.set("tlsInsecure", "true")
+		}
+		if ca != nil {
+			data["MONGODB_TLS_CA"] = string(ca)
+		}
+	}
+	if bind.CertSerial != "" {
+		data["MONGODB_TLS_CERT"] = string(cert.CertPEM)
+		data["MONGODB_TLS_KEY"] = string(cert.KeyPEM)
+		// the user comes from the certificate subject.
+		conn.Username = ""
+		conn.set("authSource", externalDB)
+	} else {
+		data["MONGODB_PASSWORD"] = bind.Password
+		conn.set("authSource", db)
+	}
+	conn.set("authMechanism", cluster.authMechanism())
+	for _, option := range plan.options() {
+		conn.set(option.Key, option.Value)
+	}
+	if bind.Kind == readBind {
+		for _, option := range plan.readOptions() {
+			conn.set(option.Key, option.Value)
+		}
+	}
+	conn.set("appName", appHost)
+	data["MONGODB_CONNECTION_STRING"] = conn.String()
+	result := make(env, len(data))
+	for key, value := range data {
+		result[bind.envName(key)] = value
+	}
+	return result, nil
 }
 
-func newBind(name, appHost string) (dbBind, error) {
+func newBind(ctx context.Context, cluster clusterConfig, instance dbInstance, appHost string, opts bindOptions, old *dbBind) (dbBind, error) {
+	name := instance.Name
 	password := newPassword()
 	username := name + newPassword()[:8]
-	err := addUser(name, username, password)
+	err := newCluster(cluster).AddUser(ctx, instance.database(), username, password, bindRole(opts.Kind))
 	if err != nil {
 		return dbBind{}, err
 	}
-	item := dbBind{AppHost: appHost, User: username, Name: name, Password: password}
-	err = collection().Insert(item)
-	if err != nil {
+	item := dbBind{
+		AppHost:   appHost,
+		User:      username,
+		Name:      name,
+		Password:  password,
+		Kind:      opts.Kind,
+		EnvPrefix: opts.EnvPrefix,
+	}
+	if err := saveBind(ctx, cluster, instance, item, old); err != nil {
 		return dbBind{}, err
 	}
 	return item, nil
 }
 
-func addUser(db, username, password string) error {
-	database := session().DB(db)
-	user := mgo.User{
-		Username: username,
-		Password: password,
-		Roles:    []mgo.Role{mgo.RoleReadWrite},
+// newCertBind creates a user authenticated by a client certificate issued by
+// the CA of the cluster.
+func newCertBind(ctx context.Context, cluster clusterConfig, instance dbInstance, appHost string, opts bindOptions, old *dbBind) (dbBind, issuedCert, error) {
+	name := instance.Name
+	ca, err := loadCertAuthority(cluster.X509)
+	if err != nil {
+		return dbBind{}, issuedCert{}, err
+	}
+	cert, err := ca.issue(name+newPassword()[:8], name, cluster.X509.Validity)
+	if err != nil {
+		return dbBind{}, issuedCert{}, err
+	}
+	err = newCluster(cluster).AddX509User(ctx, instance.database(), cert.Subject, bindRole(opts.Kind))
+	if err != nil {
+		return dbBind{}, issuedCert{}, err
 	}
-	return database.UpsertUser(&user)
+	item := dbBind{
+		AppHost:    appHost,
+		User:       cert.Subject,
+		Name:       name,
+		CertSerial: cert.Serial,
+		Kind:       opts.Kind,
+		EnvPrefix:  opts.EnvPrefix,
+	}
+	if err := saveBind(ctx, cluster, instance, item, old); err != nil {
+		return dbBind{}, issuedCert{}, err
+	}
+	return item, cert, nil
 }
 
-func unbind(name, appHost string) error {
-	locker.Lock(name)
-	defer locker.Unlock(name)
-	coll := collection()
-	bind := dbBind{Name: name, AppHost: appHost}
-	err := coll.Find(bind).One(&bind)
+// saveBind stores the given bind, whose user was already created, replacing
+// the old one when it isn't nil. The user is removed when the bind can't be
+// stored, as nothing else would remove it. The user of the old bind is
+// removed only after the new bind is stored, so a failed rotation leaves the
+// app with its current credentials.
+func saveBind(ctx context.Context, cluster clusterConfig, instance dbInstance, bind dbBind, old *dbBind) error {
+	store := getStore()
+	if old == nil {
+		if err := store.AddBind(ctx, bind); err != nil {
+			removeOrphanUser(ctx, cluster, instance, bind)
+			return err
+		}
+		audit(ctx, bind.Name, "bind", bind.AppHost)
+		return nil
+	}
+	// binds are unique by instance, app host and kind, so the old record
+	// must go before the new one is added.
+	if err := store.RemoveBind(ctx, *old); err != nil {
+		removeOrphanUser(ctx, cluster, instance, bind)
+		return err
+	}
+	if err := store.AddBind(ctx, bind); err != nil {
+		if restoreErr := store.AddBind(ctx, *old); restoreErr != nil {
+			log.Printf("failed to restore the bind of %s to %q: %s", old.AppHost, old.Name, restoreErr)
+		}
+		removeOrphanUser(ctx, cluster, instance, bind)
+		return err
+	}
+	audit(ctx, bind.Name, "rotate", bind.AppHost)
+	// the new credentials are in place: a user left behind is removed by
+	// reconcile, as it has no bind.
+	if err := removeUser(ctx, cluster, instance.database(), *old); err != nil && err != errNotFound {
+		log.Printf("failed to remove the user %q of the replaced bind of %s to %q: %s", old.User, old.AppHost, old.Name, err)
+	}
+	return nil
+}
+
+// removeOrphanUser removes the user of a bind that couldn't be stored.
+func removeOrphanUser(ctx context.Context, cluster clusterConfig, instance dbInstance, bind dbBind) {
+	if err := removeUser(ctx, cluster, instance.database(), bind); err != nil {
+		log.Printf("failed to remove the user %q of %s to %q, which has no bind: %s", bind.User, bind.AppHost, bind.Name, err)
+	}
+}
+
+// unbind removes the bind of the given kind. When the kind isn't given, the
+// app must have a single bind to the instance.
+func unbind(ctx context.Context, name, appHost string, kind *string) error {
+	if reservedName(ctx, name) {
+		return errReservedName
+	}
+	if err := lock(ctx, name); err != nil {
+		return err
+	}
+	defer unlock(ctx, name)
+	instance, _, cluster, err := getInstance(ctx, name)
+	if err != nil {
+		return err
+	}
+	store := getStore()
+	bind, err := findBind(ctx, store, name, appHost, kind)
+	if err != nil {
+		return err
+	}
+	err = store.RemoveBind(ctx, bind)
 	if err != nil {
 		return err
 	}
-	err = coll.Remove(bind)
+	audit(ctx, name, "unbind", appHost)
+	return removeUser(ctx, cluster, instance.database(), bind)
+}
+
+// rotate replaces the bind of the given kind with a new one, with new
+// credentials and the same env prefix. When the kind isn't given, the app
+// must have a single bind to the instance.
+func rotate(ctx context.Context, name, appHost string, kind *string) (env, error) {
+	if reservedName(ctx, name) {
+		return nil, errReservedName
+	}
+	if err := lock(ctx, name); err != nil {
+		return nil, err
+	}
+	defer unlock(ctx, name)
+	old, err := findBind(ctx, getStore(), name, appHost, kind)
+	if err != nil {
+		return nil, err
+	}
+	instance, plan, cluster, err := getInstance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	opts := bindOptions{Kind: old.Kind, EnvPrefix: old.EnvPrefix}
+	return bindEnv(ctx, instance, plan, cluster, appHost, opts, &old)
+}
+
+func findBind(ctx context.Context, store Store, name, appHost string, kind *string) (dbBind, error) {
+	if kind != nil {
+		bind, err := store.GetBind(ctx, name, appHost, *kind)
+		if err == errNotFound {
+			err = errBindNotFound
+		}
+		return bind, err
+	}
+	binds, err := store.ListBinds(ctx, name)
 	if err != nil {
+		return dbBind{}, err
+	}
+	var found []dbBind
+	for _, bind := range binds {
+		if bind.AppHost == appHost {
+			found = append(found, bind)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return dbBind{}, errBindNotFound
+	case 1:
+		return found[0], nil
+	}
+	return dbBind{}, errAmbiguousBind
+}
+
+// removeUser removes the user of the given bind from the cluster, where the
+// instance has the given database. Users with a client certificate live in
+// $external, and their certificate is revoked.
+func removeUser(ctx context.Context, cluster clusterConfig, db string, bind dbBind) error {
+	if bind.CertSerial == "" {
+		return newCluster(cluster).RemoveUser(ctx, db, bind.User)
+	}
+	revocation := dbRevocation{Cluster: cluster.Name, Serial: bind.CertSerial, Time: time.Now().UTC()}
+	if err := getStore().AddRevocation(ctx, revocation); err != nil {
 		return err
 	}
-	return removeUser(name, bind.User)
+	return newCluster(cluster).RemoveUser(ctx, externalDB, bind.User)
 }
 
-func removeUser(db, user string) error {
-	database := session().DB(db)
-	return database.RemoveUser(user)
+// envPrefix returns the env prefix for the given env-prefix parameter of
+// bind-app: auto derives it from the instance name, and other values must be
+// valid variable names. Prefixes are upper case.
+func envPrefix(param, name string) (string, bool) {
+	if param == "auto" {
+		param = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, name)
+		if param != "" && param[0] >= '0' && param[0] <= '9' {
+			param = "_" + param
+		}
+	} else if param != "" && !envPrefixRegexp.MatchString(param) {
+		return "", false
+	}
+	return strings.ToUpper(param), true
 }
 
 func newPassword() string {
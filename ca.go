@@ -0,0 +1,127 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// crlValidity is the amount of time a CRL served by the API is valid.
+const crlValidity = 24 * time.Hour
+
+// certAuthority issues the client certificates used by apps bound to
+// instances in clusters that authenticate with x.509.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issuedCert is a client certificate issued to an app.
+type issuedCert struct {
+	Subject string
+	Serial  string
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+func loadCertAuthority(c clusterX509Config) (*certAuthority, error) {
+	certPEM, err := ioutil.ReadFile(c.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(c.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the x509 CA: %s", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("failed to load the x509 CA: unsupported key type")
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// issue returns a new client certificate whose subject has the given common
+// name, and the instance name as the organizational unit.
+func (ca *certAuthority) issue(commonName, instance string, validity time.Duration) (issuedCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return issuedCert{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return issuedCert{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         commonName,
+			OrganizationalUnit: []string{instance},
+			Organization:       []string{"mongoapi"},
+		},
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return issuedCert{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return issuedCert{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return issuedCert{}, err
+	}
+	return issuedCert{
+		Subject: cert.Subject.String(),
+		Serial:  serial.Text(16),
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// crl returns the DER encoded revocation list of the given revocations.
+func (ca *certAuthority) crl(revocations []dbRevocation) ([]byte, error) {
+	now := time.Now().UTC()
+	list := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(crlValidity),
+	}
+	for _, r := range revocations {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q", r.Serial)
+		}
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: r.Time,
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, list, ca.cert, ca.key)
+}
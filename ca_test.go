@@ -0,0 +1,162 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// useX509 configures the default cluster to issue client certificates from
+// a new test CA.
+func (s *S) useX509(c *check.C) *testCA {
+	ca := newTestCA(c)
+	keyDER, err := x509.MarshalECPrivateKey(ca.key)
+	c.Assert(err, check.IsNil)
+	dir := c.MkDir()
+	writeFiles(c, dir, time.Now(), map[string][]byte{
+		"apps-ca.pem":     ca.pem,
+		"apps-ca-key.pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	})
+	s.conf.Clusters[0].TLS = clusterTLSConfig{Enabled: true}
+	s.conf.Clusters[0].X509 = clusterX509Config{
+		CACertFile: filepath.Join(dir, "apps-ca.pem"),
+		CAKeyFile:  filepath.Join(dir, "apps-ca-key.pem"),
+		Validity:   time.Hour,
+	}
+	return ca
+}
+
+func (s *S) crl(c *check.C, cluster string) *x509.RevocationList {
+	request, err := http.NewRequest("GET", "/clusters/"+cluster+"/crl", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/pkix-crl")
+	crl, err := x509.ParseRevocationList(recorder.Body.Bytes())
+	c.Assert(err, check.IsNil)
+	return crl
+}
+
+func (s *S) TestCertAuthorityIssue(c *check.C) {
+	ca := s.useX509(c)
+	authority, err := loadCertAuthority(s.conf.Clusters[0].X509)
+	c.Assert(err, check.IsNil)
+	issued, err := authority.issue("myapp1234", "myapp", time.Hour)
+	c.Assert(err, check.IsNil)
+	pair, err := tls.X509KeyPair(issued.CertPEM, issued.KeyPEM)
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(cert.Subject.String(), check.Equals, "CN=myapp1234,OU=myapp,O=mongoapi")
+	c.Assert(issued.Subject, check.Equals, cert.Subject.String())
+	c.Assert(cert.SerialNumber.Text(16), check.Equals, issued.Serial)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestLoadCertAuthorityInvalidKey(c *check.C) {
+	s.useX509(c)
+	other := newTestCA(c)
+	keyDER, err := x509.MarshalECPrivateKey(other.key)
+	c.Assert(err, check.IsNil)
+	writeFiles(c, filepath.Dir(s.conf.Clusters[0].X509.CAKeyFile), time.Now(), map[string][]byte{
+		"apps-ca-key.pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	})
+	_, err = loadCertAuthority(s.conf.Clusters[0].X509)
+	c.Assert(err, check.ErrorMatches, "failed to load the x509 CA: .*")
+}
+
+func (s *S) TestBindWithX509(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	ca := s.useX509(c)
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(env["MONGODB_PASSWORD"], check.Equals, "")
+	c.Assert(env["MONGODB_CONNECTION_STRING"], check.Equals,
+		"mongodb://127.0.0.1:27017/myapp?tls=true&authSource=%24external&authMechanism=MONGODB-X509&appName=localhost")
+	pair, err := tls.X509KeyPair([]byte(env["MONGODB_TLS_CERT"]), []byte(env["MONGODB_TLS_KEY"]))
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(cert.CheckSignatureFrom(ca.cert), check.IsNil)
+	c.Assert(cert.Subject.String(), check.Equals, env["MONGODB_USER"])
+	c.Assert(strings.HasPrefix(cert.Subject.CommonName, "myapp"), check.Equals, true)
+	c.Assert(s.cluster.password(externalDB, env["MONGODB_USER"]), check.Equals, "myapp")
+	c.Assert(s.cluster.users["myapp"], check.HasLen, 0)
+	c.Assert(s.store.binds, check.DeepEquals, []dbBind{
+		{Name: "myapp", AppHost: "localhost", User: env["MONGODB_USER"], CertSerial: cert.SerialNumber.Text(16)},
+	})
+}
+
+func (s *S) TestUnbindWithX509RevokesTheCertificate(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	ca := s.useX509(c)
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	crl := s.crl(c, "default")
+	c.Assert(crl.CheckSignatureFrom(ca.cert), check.IsNil)
+	c.Assert(crl.RevokedCertificateEntries, check.HasLen, 0)
+	err = unbind(context.Background(), "myapp", "localhost", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cluster.password(externalDB, env["MONGODB_USER"]), check.Equals, "")
+	block, _ := pem.Decode([]byte(env["MONGODB_TLS_CERT"]))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, check.IsNil)
+	crl = s.crl(c, "default")
+	c.Assert(crl.CheckSignatureFrom(ca.cert), check.IsNil)
+	c.Assert(crl.RevokedCertificateEntries, check.HasLen, 1)
+	c.Assert(crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber), check.Equals, 0)
+}
+
+func (s *S) TestBindWithX509StoreFailureRevokesTheCertificate(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.useX509(c)
+	s.store.fail("AddBind", errors.New("store is down"))
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.ErrorMatches, "store is down")
+	c.Assert(s.cluster.users[externalDB], check.HasLen, 0)
+	c.Assert(s.store.revocations, check.HasLen, 1)
+}
+
+func (s *S) TestRemoveWithX509RevokesTheCertificates(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.useX509(c)
+	first, err := bind(context.Background(), "myapp", "app1", bindOptions{})
+	c.Assert(err, check.IsNil)
+	second, err := bind(context.Background(), "myapp", "app2", bindOptions{})
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(s.cluster.users[externalDB], check.HasLen, 0)
+	c.Assert(s.store.revocations, check.HasLen, 2)
+	c.Assert(first["MONGODB_USER"], check.Not(check.Equals), second["MONGODB_USER"])
+}
+
+func (s *S) TestCRLUnknownCluster(c *check.C) {
+	for _, cluster := range []string{"unknown", "default"} {
+		request, err := http.NewRequest("GET", "/clusters/"+cluster+"/crl", nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		s.muxer.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusNotFound)
+	}
+}
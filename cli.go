@@ -0,0 +1,215 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of the mongoapi binary, run after the config is
+// loaded. Subcommands use the same code as the API, so operators can manage
+// instances and binds without calling it.
+type command struct {
+	usage string
+	help  string
+	run   func(args []string, w io.Writer) error
+}
+
+var commands = map[string]command{
+	"serve": {
+		help: "Run the service API (the default command)",
+		run:  serveCommand,
+	},
+	"instances list": {
+		usage: "[-team team]",
+		help:  "List the instances, with their size and number of binds",
+		run:   instancesListCommand,
+	},
+	"binds list": {
+		usage: "<instance>",
+		help:  "List the binds of an instance",
+		run:   bindsListCommand,
+	},
+	"rotate": {
+		usage: "[-access read|read-write] <instance> <app-host>",
+		help:  "Replace the credentials of a bind, printing its new env",
+		run:   rotateCommand,
+	},
+	"reconcile": {
+		usage: "[-dry-run]",
+		help:  "Add missing users of binds to the clusters, and remove users without binds",
+		run:   reconcileCommand,
+	},
+	"migrate": {
+		help: "Apply the pending migrations of the metadata store, also applied when serving",
+		run:  migrateCommand,
+	},
+}
+
+// usageError is returned by commands given invalid arguments.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+// runCommand runs the subcommand in args, writing its output to w. Commands
+// may have two words, like "instances list".
+func runCommand(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	name, rest := args[0], args[1:]
+	if len(args) > 1 {
+		if _, ok := commands[args[0]+" "+args[1]]; ok {
+			name, rest = args[0]+" "+args[1], args[2:]
+		}
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, run mongoapi -h for the list of commands", strings.Join(args, " "))
+	}
+	err := cmd.run(rest, w)
+	if e, ok := err.(usageError); ok {
+		return fmt.Errorf("%s\nusage: mongoapi %s %s", e.err, name, cmd.usage)
+	}
+	return err
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: mongoapi [flags] [command]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(w, "  %s %s\n    \t%s\n", name, cmd.usage, cmd.help)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// parseArgs parses the flags of the given command, requiring n positional
+// arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) error {
+	fs.SetOutput(ioutil.Discard)
+	err := fs.Parse(args)
+	if err == nil && fs.NArg() != n {
+		err = fmt.Errorf("expected %d arguments, got %d", n, fs.NArg())
+	}
+	if err != nil {
+		return usageError{err}
+	}
+	return nil
+}
+
+func serveCommand(args []string, w io.Writer) error {
+	if err := parseArgs(flag.NewFlagSet("serve", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	return serve(currentConfig())
+}
+
+func instancesListCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("instances list", flag.ContinueOnError)
+	team := fs.String("team", "", "List only the instances of this team")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	items, err := listInstances(context.Background(), *team)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTEAM\tPLAN\tCLUSTER\tDATABASE\tSIZE\tBINDS")
+	for _, item := range items {
+		size := strconv.FormatInt(item.Size, 10)
+		if item.Size == unknownSize {
+			size = "unknown"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", item.Name, item.Team, item.Plan, item.Cluster, item.Database, size, item.Binds)
+	}
+	return tw.Flush()
+}
+
+func bindsListCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("binds list", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	binds, err := getStore().ListBinds(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sort.Slice(binds, func(i, j int) bool {
+		if binds[i].AppHost != binds[j].AppHost {
+			return binds[i].AppHost < binds[j].AppHost
+		}
+		return binds[i].Kind < binds[j].Kind
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "APP HOST\tACCESS\tUSER\tENV PREFIX")
+	for _, bind := range binds {
+		access := "read-write"
+		if bind.Kind == readBind {
+			access = "read"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", bind.AppHost, access, bind.User, bind.EnvPrefix)
+	}
+	return tw.Flush()
+}
+
+func rotateCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	access := fs.String("access", "", "Access of the bind, required when the app has both kinds of bind")
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+	var kind *string
+	if *access != "" {
+		k, ok := bindKind(*access)
+		if !ok {
+			return usageError{fmt.Errorf("invalid access %q, must be read or read-write", *access)}
+		}
+		kind = &k
+	}
+	env, err := rotate(context.Background(), fs.Arg(0), fs.Arg(1), kind)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(env)
+}
+
+func reconcileCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only print the changes")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	return reconcile(context.Background(), *dryRun, w)
+}
+
+func migrateCommand(args []string, w io.Writer) error {
+	if err := parseArgs(flag.NewFlagSet("migrate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	return migrate(context.Background(), w)
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) run(c *check.C, args ...string) string {
+	var out bytes.Buffer
+	err := runCommand(args, &out)
+	c.Assert(err, check.IsNil)
+	return out.String()
+}
+
+func (s *S) TestRunCommandUnknown(c *check.C) {
+	err := runCommand([]string{"instances", "remove"}, &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, `unknown command "instances remove", run mongoapi -h for the list of commands`)
+}
+
+func (s *S) TestRunCommandUsage(c *check.C) {
+	err := runCommand([]string{"binds", "list"}, &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, "expected 1 arguments, got 0\nusage: mongoapi binds list <instance>")
+	err = runCommand([]string{"rotate", "-access", "write", "myapp", "app1"}, &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, `invalid access "write", must be read or read-write\n.*`)
+	err = runCommand([]string{"reconcile", "-force"}, &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, "flag provided but not defined: -force\nusage: mongoapi reconcile \\[-dry-run\\]")
+}
+
+func (s *S) TestInstancesListCommand(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Team: "payments", Database: "myapp_db"})
+	s.store.AddInstance(context.Background(), dbInstance{Name: "another", Team: "search"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1"})
+	s.cluster.sizes["myapp_db"] = 4096
+	c.Assert(s.run(c, "instances", "list", "-team", "payments"), check.Equals, ""+
+		"NAME   TEAM      PLAN  CLUSTER  DATABASE  SIZE  BINDS\n"+
+		"myapp  payments        default  myapp_db  4096  1\n")
+}
+
+func (s *S) TestInstancesListCommandUnknownSize(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Cluster: "default", Database: "myapp_db"})
+	s.cluster.fail("DatabaseSize", errClusterUnavailable)
+	c.Assert(s.run(c, "instances", "list"), check.Equals, ""+
+		"NAME   TEAM  PLAN  CLUSTER  DATABASE  SIZE     BINDS\n"+
+		"myapp              default  myapp_db  unknown  0\n")
+}
+
+func (s *S) TestBindsListCommand(c *check.C) {
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app2", User: "myappfedcba98", Kind: readBind, EnvPrefix: "BI"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1", User: "myapp01234567"})
+	c.Assert(s.run(c, "binds", "list", "myapp"), check.Equals, ""+
+		"APP HOST  ACCESS      USER           ENV PREFIX\n"+
+		"app1      read-write  myapp01234567  \n"+
+		"app2      read        myappfedcba98  BI\n")
+}
+
+func (s *S) TestRotateCommand(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	env, err := bind(context.Background(), "myapp", "app1", bindOptions{Kind: readBind, EnvPrefix: "BI"})
+	c.Assert(err, check.IsNil)
+	out := s.run(c, "rotate", "myapp", "app1")
+	var rotated map[string]string
+	c.Assert(json.Unmarshal([]byte(out), &rotated), check.IsNil)
+	c.Assert(rotated["BI_MONGODB_READ_USER"], check.Not(check.Equals), env["BI_MONGODB_READ_USER"])
+	c.Assert(s.cluster.password("myapp", env["BI_MONGODB_READ_USER"]), check.Equals, "")
+	c.Assert(s.cluster.password("myapp", rotated["BI_MONGODB_READ_USER"]), check.Equals, rotated["BI_MONGODB_READ_PASSWORD"])
+	c.Assert(s.cluster.roles[rotated["BI_MONGODB_READ_USER"]], check.Equals, "read")
+	binds, err := s.store.ListBinds(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 1)
+	c.Assert(binds[0].User, check.Equals, rotated["BI_MONGODB_READ_USER"])
+}
+
+func (s *S) TestRotateKeepsTheBindOnFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	env, err := bind(context.Background(), "myapp", "app1", bindOptions{})
+	c.Assert(err, check.IsNil)
+	s.cluster.fail("AddUser", errors.New("not authorized"))
+	_, err = rotate(context.Background(), "myapp", "app1", nil)
+	c.Assert(err, check.ErrorMatches, "not authorized")
+	c.Assert(s.cluster.password("myapp", env["MONGODB_USER"]), check.Equals, env["MONGODB_PASSWORD"])
+	binds, err := s.store.ListBinds(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 1)
+	c.Assert(binds[0].User, check.Equals, env["MONGODB_USER"])
+}
+
+func (s *S) TestRotateWaitsForTheLock(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	_, err := bind(context.Background(), "myapp", "app1", bindOptions{})
+	c.Assert(err, check.IsNil)
+	acquired, err := s.store.Lock(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(acquired, check.Equals, true)
+	defer s.store.Unlock(context.Background(), "myapp")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rotate(ctx, "myapp", "app1", nil)
+	c.Assert(err, check.NotNil)
+	binds, err := s.store.ListBinds(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 1)
+}
+
+func (s *S) TestRotateCommandNotFound(c *check.C) {
+	err := runCommand([]string{"rotate", "myapp", "app1"}, &bytes.Buffer{})
+	c.Assert(err, check.Equals, errBindNotFound)
+}
+
+func (s *S) TestReconcileCommand(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Database: "myapp_db"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1", User: "myapp01234567", Password: "secret", Kind: readBind})
+	s.store.AddBind(context.Background(), dbBind{Name: "legacy", AppHost: "app2", User: "legacy01234567", Password: "secret"})
+	s.cluster.AddUser(context.Background(), "legacy", "legacy01234567", "secret", "readWrite")
+	s.cluster.AddUser(context.Background(), "myapp_db", "myappfedcba98", "old", "readWrite")
+	s.cluster.AddUser(context.Background(), "myapp_db", "backup", "secret", "read")
+	expected := "myapp: adding missing user \"myapp01234567\" of app1\n" +
+		"myapp: removing user \"myappfedcba98\" without a bind\n"
+	c.Assert(s.run(c, "reconcile", "-dry-run"), check.Equals, expected)
+	c.Assert(s.cluster.password("myapp_db", "myapp01234567"), check.Equals, "")
+	c.Assert(s.run(c, "reconcile"), check.Equals, expected)
+	c.Assert(s.cluster.password("myapp_db", "myapp01234567"), check.Equals, "secret")
+	c.Assert(s.cluster.roles["myapp01234567"], check.Equals, "read")
+	c.Assert(s.cluster.password("myapp_db", "myappfedcba98"), check.Equals, "")
+	c.Assert(s.cluster.password("myapp_db", "backup"), check.Equals, "secret")
+	c.Assert(s.run(c, "reconcile"), check.Equals, "")
+}
+
+func (s *S) TestMigrateCommand(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Database: "myapp_db"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1"})
+	s.store.AddBind(context.Background(), dbBind{Name: "legacy", AppHost: "app1"})
+	s.store.AddBind(context.Background(), dbBind{Name: "legacy", AppHost: "app2"})
+	c.Assert(s.run(c, "migrate"), check.Equals, ""+
+		"applying migration 1: add the records of instances created before the store\n"+
+		"legacy: added the record of the instance\n"+
+		"applying migration 2: create the indexes of the metadata\n"+
+		"applying migration 3: make the databases of instances unique in each cluster\n")
+	instance, err := s.store.GetInstance(context.Background(), "legacy")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Database, check.Equals, "legacy")
+	c.Assert(s.store.migrations, check.HasLen, len(migrations))
+	c.Assert(s.run(c, "migrate"), check.Equals, "")
+	c.Assert(s.store.locks, check.HasLen, 0)
+}
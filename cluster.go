@@ -0,0 +1,101 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Cluster is the set of operations the service runs in the MongoDB server
+// that hosts the service instances.
+type Cluster interface {
+	// AddUser creates a user in db with the given role, readWrite or read.
+	AddUser(ctx context.Context, db, username, password, role string) error
+	// AddX509User creates a user in $external, authenticated by the client
+	// certificate with the given subject, with the given role in db.
+	AddX509User(ctx context.Context, db, subject, role string) error
+	RemoveUser(ctx context.Context, db, username string) error
+	DropDatabase(ctx context.Context, db string) error
+	Ping(ctx context.Context) error
+	// EnableSharding enables sharding for the given database, with the given
+	// primary shard, or one picked by the cluster when it's empty.
+	EnableSharding(ctx context.Context, db, primaryShard string) error
+	// ZoneShards returns the shards in the given zone, sorted by name.
+	ZoneShards(ctx context.Context, zone string) ([]string, error)
+	ChunkDistribution(ctx context.Context, db string) (chunkDistribution, error)
+	DatabaseExists(ctx context.Context, db string) (bool, error)
+	// Users returns the names of the users of the given database, sorted.
+	Users(ctx context.Context, db string) ([]string, error)
+	// DatabaseSize returns the size of the given database on disk, including
+	// indexes, in bytes.
+	DatabaseSize(ctx context.Context, db string) (int64, error)
+	// Topology returns the replica set of the cluster and its members, as
+	// known inside the cluster. Both are empty for servers that aren't part
+	// of a replica set.
+	Topology(ctx context.Context) (topology, error)
+}
+
+// externalDB is the database of users authenticated outside of MongoDB, like
+// the ones using client certificates.
+const externalDB = "$external"
+
+// newCluster returns the Cluster for the given config.
+var newCluster = func(c clusterConfig) Cluster {
+	return mongoCluster{conf: c}
+}
+
+// instanceCluster returns the config of the cluster that hosts the given
+// instance, based on its plan.
+func instanceCluster(ctx context.Context, name string) (clusterConfig, error) {
+	_, _, cluster, err := getInstance(ctx, name)
+	return cluster, err
+}
+
+var (
+	errInstanceNotFound = &httpError{code: http.StatusNotFound, kind: "instance-not-found", body: "Instance not found"}
+	// errInstanceClusterNotFound is returned for instances whose cluster was
+	// removed from the config, which can't be managed until it's back.
+	errInstanceClusterNotFound = &httpError{code: http.StatusServiceUnavailable, kind: "cluster-not-found", body: "The cluster of the instance is not in the config"}
+)
+
+// getInstance returns the record of the given instance, along with the
+// config of its plan and of the cluster that hosts it. Instances created
+// before the store was introduced get a record with just their name. The plan
+// is empty when no plans are configured.
+func getInstance(ctx context.Context, name string) (dbInstance, planConfig, clusterConfig, error) {
+	instance, err := getStore().GetInstance(ctx, name)
+	if err == errNotFound {
+		instance, err = dbInstance{Name: name}, legacyInstance(ctx, name)
+	}
+	if err != nil {
+		return dbInstance{}, planConfig{}, clusterConfig{}, err
+	}
+	conf := contextConfig(ctx)
+	var plan planConfig
+	if instance.Plan != "" {
+		plan, _ = conf.plan(instance.Plan)
+	}
+	cluster, ok := conf.instanceCluster(instance)
+	if !ok {
+		return dbInstance{}, planConfig{}, clusterConfig{}, errInstanceClusterNotFound
+	}
+	return instance, plan, cluster, nil
+}
+
+// legacyInstance returns errInstanceNotFound unless the given instance, which
+// has no record, was created before the store was introduced, which is known
+// by its binds. Databases of the cluster aren't enough, as they may belong to
+// other instances or to other users of the cluster.
+func legacyInstance(ctx context.Context, name string) error {
+	binds, err := getStore().ListBinds(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(binds) == 0 {
+		return errInstanceNotFound
+	}
+	return nil
+}
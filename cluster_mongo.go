@@ -0,0 +1,247 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Error codes of the user management commands.
+const (
+	userNotFoundCode      = 11
+	userAlreadyExistsCode = 51003
+)
+
+// mongoCluster is a Cluster backed by the client connected to the cluster
+// described in conf.
+type mongoCluster struct {
+	conf clusterConfig
+}
+
+// run runs op with the client of the cluster, bound to ctx.
+func (c mongoCluster) run(ctx context.Context, op func(context.Context, *mongo.Client) error) error {
+	return withClient(ctx, c.conf, op)
+}
+
+// AddUser lets the server hash the password, and only sets the mechanism
+// when it isn't SCRAM-SHA-1, which servers older than 4.0 don't accept.
+func (c mongoCluster) AddUser(ctx context.Context, db, username, password, role string) error {
+	user := bson.D{
+		{Key: "pwd", Value: password},
+		{Key: "roles", Value: bson.A{role}},
+	}
+	if mechanism := c.conf.authMechanism(); mechanism != "SCRAM-SHA-1" {
+		user = append(user, bson.E{Key: "mechanisms", Value: bson.A{mechanism}})
+	}
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return upsertUser(ctx, client.Database(db), username, user)
+	})
+}
+
+func (c mongoCluster) AddX509User(ctx context.Context, db, subject, role string) error {
+	user := bson.D{{Key: "roles", Value: bson.A{bson.D{{Key: "role", Value: role}, {Key: "db", Value: db}}}}}
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return upsertUser(ctx, client.Database(externalDB), subject, user)
+	})
+}
+
+// upsertUser creates the given user in db, or updates it when it already
+// exists.
+func upsertUser(ctx context.Context, db *mongo.Database, username string, user bson.D) error {
+	cmd := append(bson.D{{Key: "createUser", Value: username}}, user...)
+	err := db.RunCommand(ctx, cmd).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == userAlreadyExistsCode {
+		cmd = append(bson.D{{Key: "updateUser", Value: username}}, user...)
+		err = db.RunCommand(ctx, cmd).Err()
+	}
+	return err
+}
+
+func (c mongoCluster) RemoveUser(ctx context.Context, db, username string) error {
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		err := client.Database(db).RunCommand(ctx, bson.D{{Key: "dropUser", Value: username}}).Err()
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == userNotFoundCode {
+			return errNotFound
+		}
+		return err
+	})
+}
+
+func (c mongoCluster) DropDatabase(ctx context.Context, db string) error {
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Database(db).Drop(ctx)
+	})
+}
+
+// DatabaseExists compares the names ignoring case, as MongoDB doesn't allow
+// databases whose names differ only in case.
+func (c mongoCluster) DatabaseExists(ctx context.Context, db string) (bool, error) {
+	var names []string
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) (err error) {
+		names, err = client.ListDatabaseNames(ctx, bson.D{})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, db) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c mongoCluster) Users(ctx context.Context, db string) ([]string, error) {
+	var result struct {
+		Users []struct {
+			User string `bson:"user"`
+		} `bson:"users"`
+	}
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Database(db).RunCommand(ctx, bson.D{{Key: "usersInfo", Value: 1}}).Decode(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, len(result.Users))
+	for i, u := range result.Users {
+		users[i] = u.User
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (c mongoCluster) DatabaseSize(ctx context.Context, db string) (int64, error) {
+	var result struct {
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Database(db).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&result)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(result.StorageSize + result.IndexSize), nil
+}
+
+func (c mongoCluster) Ping(ctx context.Context) error {
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Ping(ctx, nil)
+	})
+}
+
+// Topology runs isMaster, which, unlike replSetGetStatus, doesn't require the
+// clusterMonitor role. Hidden members and arbiters are left out, as apps
+// don't connect to them.
+func (c mongoCluster) Topology(ctx context.Context) (topology, error) {
+	var result struct {
+		SetName  string   `bson:"setName"`
+		Hosts    []string `bson:"hosts"`
+		Passives []string `bson:"passives"`
+	}
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+	})
+	if err != nil {
+		return topology{}, err
+	}
+	return topology{ReplicaSet: result.SetName, Hosts: append(result.Hosts, result.Passives...)}, nil
+}
+
+func (c mongoCluster) EnableSharding(ctx context.Context, db, primaryShard string) error {
+	cmd := bson.D{{Key: "enableSharding", Value: db}}
+	if primaryShard != "" {
+		cmd = append(cmd, bson.E{Key: "primaryShard", Value: primaryShard})
+	}
+	return c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		return client.Database("admin").RunCommand(ctx, cmd).Err()
+	})
+}
+
+func (c mongoCluster) ZoneShards(ctx context.Context, zone string) ([]string, error) {
+	var shards []struct {
+		ID string `bson:"_id"`
+	}
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := client.Database("config").Collection("shards").Find(ctx, bson.M{"tags": zone}, opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &shards)
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(shards))
+	for i, shard := range shards {
+		names[i] = shard.ID
+	}
+	return names, nil
+}
+
+// ChunkDistribution reads the chunks from the config database. Chunks refer
+// to their collection by namespace before MongoDB 5.0, and by UUID after it.
+func (c mongoCluster) ChunkDistribution(ctx context.Context, db string) (chunkDistribution, error) {
+	var distribution chunkDistribution
+	err := c.run(ctx, func(ctx context.Context, client *mongo.Client) error {
+		config := client.Database("config")
+		var collections []struct {
+			ID   string      `bson:"_id"`
+			UUID interface{} `bson:"uuid"`
+		}
+		query := bson.M{
+			"_id":     primitive.Regex{Pattern: "^" + regexp.QuoteMeta(db+".")},
+			"dropped": bson.M{"$ne": true},
+		}
+		cursor, err := config.Collection("collections").Find(ctx, query)
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(ctx, &collections); err != nil {
+			return err
+		}
+		distribution = make(chunkDistribution, len(collections))
+		for _, coll := range collections {
+			match := bson.M{"ns": coll.ID}
+			if coll.UUID != nil {
+				match = bson.M{"$or": bson.A{bson.M{"ns": coll.ID}, bson.M{"uuid": coll.UUID}}}
+			}
+			var groups []struct {
+				Shard string `bson:"_id"`
+				Count int    `bson:"count"`
+			}
+			cursor, err := config.Collection("chunks").Aggregate(ctx, bson.A{
+				bson.M{"$match": match},
+				bson.M{"$group": bson.M{"_id": "$shard", "count": bson.M{"$sum": 1}}},
+			})
+			if err != nil {
+				return err
+			}
+			if err := cursor.All(ctx, &groups); err != nil {
+				return err
+			}
+			distribution[coll.ID] = make(map[string]int, len(groups))
+			for _, g := range groups {
+				distribution[coll.ID][g.Shard] = g.Count
+			}
+		}
+		return nil
+	})
+	return distribution, err
+}
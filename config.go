@@ -0,0 +1,553 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config is the configuration of the service, loaded from the file given in
+// the -config flag. Environment variables override the values in the file.
+type config struct {
+	Listen   string          `yaml:"listen"`
+	Metadata metadataConfig  `yaml:"metadata"`
+	Auth     authConfig      `yaml:"auth"`
+	TLS      tlsConfig       `yaml:"tls"`
+	DNS      dnsConfig       `yaml:"dns"`
+	Clusters []clusterConfig `yaml:"clusters"`
+	Plans    []planConfig    `yaml:"plans"`
+	// ReservedNames are patterns, in the syntax of path.Match, of instance
+	// names that can't be used, besides the system databases.
+	ReservedNames []string `yaml:"reserved-names"`
+	// ShutdownTimeout is how long the API waits for running requests when
+	// it's stopped.
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	// OperationTimeout is the maximum duration of each MongoDB operation,
+	// in the clusters and in the metadata store.
+	OperationTimeout time.Duration `yaml:"operation-timeout"`
+}
+
+// metadataConfig describes where the service metadata is stored.
+type metadataConfig struct {
+	Store    string `yaml:"store"`
+	Database string `yaml:"database"`
+	Path     string `yaml:"path"`
+}
+
+// authConfig holds the credentials tsuru uses to call the service API.
+type authConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// tlsConfig holds the certificate used to serve the service API and,
+// optionally, the CA used to verify client certificates.
+type tlsConfig struct {
+	CertFile     string `yaml:"cert-file"`
+	KeyFile      string `yaml:"key-file"`
+	ClientCAFile string `yaml:"client-ca-file"`
+}
+
+// dnsConfig describes the DNS server that answers queries for the seedlist
+// names of the clusters.
+type dnsConfig struct {
+	Listen string        `yaml:"listen"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// clusterConfig describes a MongoDB server where instances are created.
+type clusterConfig struct {
+	Name       string            `yaml:"name"`
+	URI        string            `yaml:"uri"`
+	PublicURI  string            `yaml:"public-uri"`
+	ReplicaSet string            `yaml:"replica-set"`
+	TLS        clusterTLSConfig  `yaml:"tls"`
+	X509       clusterX509Config `yaml:"x509"`
+	// Seedlist is the DNS name published to bound apps, in mongodb+srv://
+	// connection strings, instead of the hosts in PublicURI.
+	Seedlist string `yaml:"seedlist"`
+	// Discover makes the replica set and the public hosts handed out to apps
+	// come from the members of the cluster, translated with HostMap,
+	// instead of ReplicaSet and PublicURI.
+	Discover bool              `yaml:"discover"`
+	HostMap  map[string]string `yaml:"host-map"`
+	// AuthMechanism is the mechanism of the users created for bound apps,
+	// SCRAM-SHA-1 or SCRAM-SHA-256. It's ignored when the cluster issues
+	// client certificates.
+	AuthMechanism string `yaml:"auth-mechanism"`
+}
+
+// clusterTLSConfig describes how the service connects to a cluster that
+// requires TLS. With X509Auth, the service authenticates with the client
+// certificate instead of the credentials in the URI.
+type clusterTLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CAFile   string `yaml:"ca-file"`
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+	Insecure bool   `yaml:"insecure"`
+	X509Auth bool   `yaml:"x509-auth"`
+}
+
+// clusterX509Config holds the CA used to issue client certificates to apps
+// bound to instances in the cluster. When it is set, apps authenticate with
+// x.509 instead of passwords.
+type clusterX509Config struct {
+	CACertFile string        `yaml:"ca-cert-file"`
+	CAKeyFile  string        `yaml:"ca-key-file"`
+	Validity   time.Duration `yaml:"validity"`
+}
+
+// planConfig describes a plan offered to tsuru users, and the cluster where
+// instances of the plan are created.
+type planConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Cluster     string `yaml:"cluster"`
+	// Options are added to the connection strings of the apps bound to
+	// instances of the plan, like readPreference or w.
+	Options map[string]string `yaml:"options"`
+	// ReadOptions are added to the connection strings of read-only binds,
+	// after Options. The default is readPreference=secondaryPreferred.
+	ReadOptions map[string]string `yaml:"read-options"`
+	Sharding    shardingConfig    `yaml:"sharding"`
+	// MaxInstances is the maximum number of instances of the plan, or zero
+	// for no limit.
+	MaxInstances int `yaml:"max-instances"`
+}
+
+// shardingConfig describes how databases of a plan are sharded, in clusters
+// behind a mongos. The primary shard is either the given one, or the first
+// shard in the given zone.
+type shardingConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	PrimaryShard string `yaml:"primary-shard"`
+	Zone         string `yaml:"zone"`
+}
+
+var (
+	conf    *config
+	confMut sync.Mutex
+)
+
+// currentConfig returns the configuration in use, loading it from the
+// environment on first use.
+func currentConfig() *config {
+	confMut.Lock()
+	defer confMut.Unlock()
+	if conf == nil {
+		var err error
+		conf, err = loadConfig("")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return conf
+}
+
+func setConfig(c *config) {
+	confMut.Lock()
+	conf = c
+	confMut.Unlock()
+}
+
+type configKey struct{}
+
+// withConfig returns a copy of ctx that carries the given config, so an
+// operation keeps using it when the config is reloaded while it runs.
+func withConfig(ctx context.Context, c *config) context.Context {
+	return context.WithValue(ctx, configKey{}, c)
+}
+
+// contextConfig returns the config carried by ctx, or the one in use when
+// ctx doesn't carry one.
+func contextConfig(ctx context.Context) *config {
+	if c, ok := ctx.Value(configKey{}).(*config); ok {
+		return c
+	}
+	return currentConfig()
+}
+
+// loadConfig reads the configuration file in the given path, applies the
+// environment variables and validates the result. An empty path loads the
+// configuration from the environment only.
+func loadConfig(path string) (*config, error) {
+	var c config
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &c); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+		}
+	}
+	c.applyEnv()
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	return &c, nil
+}
+
+// applyEnv overrides the values in the config with the ones defined in the
+// environment. Variables related to a cluster apply to the default cluster.
+func (c *config) applyEnv() {
+	c.Metadata.Store = coalesceEnv("MONGOAPI_STORE", c.Metadata.Store)
+	c.Metadata.Path = coalesceEnv("MONGOAPI_STORE_PATH", c.Metadata.Path)
+	c.Metadata.Database = coalesceEnv("MONGOAPI_DBNAME", c.Metadata.Database)
+	if len(c.Clusters) == 0 {
+		c.Clusters = []clusterConfig{{Name: "default"}}
+	}
+	def := &c.Clusters[0]
+	def.URI = coalesceEnv("MONGODB_URI", def.URI)
+	def.PublicURI = coalesceEnv("MONGODB_PUBLIC_URI", def.PublicURI)
+	def.ReplicaSet = coalesceEnv("MONGODB_REPLICA_SET", def.ReplicaSet)
+}
+
+func (c *config) setDefaults() {
+	if c.Listen == "" {
+		c.Listen = "0.0.0.0:3030"
+	}
+	if c.Metadata.Store == "" {
+		c.Metadata.Store = "mongodb"
+	}
+	if c.Metadata.Database == "" {
+		c.Metadata.Database = "mongoapi"
+	}
+	if c.Metadata.Path == "" {
+		c.Metadata.Path = "mongoapi.db"
+	}
+	if c.DNS.TTL == 0 {
+		c.DNS.TTL = time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if c.OperationTimeout == 0 {
+		c.OperationTimeout = 10 * time.Second
+	}
+	for i := range c.Clusters {
+		cluster := &c.Clusters[i]
+		if cluster.URI == "" {
+			cluster.URI = "127.0.0.1:27017"
+		}
+		if cluster.PublicURI == "" {
+			cluster.PublicURI = uriHosts(cluster.URI)
+		}
+		if cluster.X509.enabled() && cluster.X509.Validity == 0 {
+			cluster.X509.Validity = 365 * 24 * time.Hour
+		}
+	}
+	for i := range c.Plans {
+		if c.Plans[i].Cluster == "" {
+			c.Plans[i].Cluster = c.Clusters[0].Name
+		}
+	}
+}
+
+// uriHosts returns the hosts of the given URI, which may be a connection
+// string: its credentials and options are for the API, not for bound apps.
+// SRV URIs keep their scheme, as apps resolve them.
+func uriHosts(uri string) string {
+	if !strings.HasPrefix(uri, connScheme) && !strings.HasPrefix(uri, connSRVScheme) {
+		return uri
+	}
+	conn, err := parseConnString(uri)
+	if err != nil {
+		return ""
+	}
+	hosts := strings.Join(conn.Hosts, ",")
+	if conn.SRV {
+		return connSRVScheme + hosts
+	}
+	return hosts
+}
+
+func (c *config) validate() error {
+	switch c.Metadata.Store {
+	case "mongodb", "bolt":
+	default:
+		return fmt.Errorf("metadata: unknown store %q, must be mongodb or bolt", c.Metadata.Store)
+	}
+	if (c.Auth.Username == "") != (c.Auth.Password == "") {
+		return fmt.Errorf("auth: username and password must be set together")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert-file and key-file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls: client-ca-file requires cert-file and key-file")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown-timeout must be positive")
+	}
+	if c.OperationTimeout < 0 {
+		return fmt.Errorf("operation-timeout must be positive")
+	}
+	for i, pattern := range c.ReservedNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("reserved-names[%d]: invalid pattern %q", i, pattern)
+		}
+	}
+	clusters := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("clusters[%d]: name is required", i)
+		}
+		if clusters[cluster.Name] {
+			return fmt.Errorf("clusters[%d]: duplicate cluster %q", i, cluster.Name)
+		}
+		switch cluster.AuthMechanism {
+		case "", "SCRAM-SHA-1", "SCRAM-SHA-256":
+		default:
+			return fmt.Errorf("clusters[%d]: unknown auth-mechanism %q, must be SCRAM-SHA-1 or SCRAM-SHA-256", i, cluster.AuthMechanism)
+		}
+		if cluster.Discover && strings.HasPrefix(cluster.PublicURI, connSRVScheme) {
+			return fmt.Errorf("clusters[%d]: discover can't be used with a mongodb+srv:// public-uri", i)
+		}
+		if len(cluster.HostMap) > 0 && !cluster.Discover {
+			return fmt.Errorf("clusters[%d]: host-map requires discover", i)
+		}
+		if err := cluster.validateSeedlist(); err != nil {
+			return fmt.Errorf("clusters[%d]: %s", i, err)
+		}
+		if cluster.Seedlist != "" && c.DNS.Listen == "" {
+			return fmt.Errorf("clusters[%d]: seedlist requires dns.listen", i)
+		}
+		if err := cluster.TLS.validate(); err != nil {
+			return fmt.Errorf("clusters[%d].tls: %s", i, err)
+		}
+		if err := cluster.X509.validate(cluster.TLS); err != nil {
+			return fmt.Errorf("clusters[%d].x509: %s", i, err)
+		}
+		clusters[cluster.Name] = true
+	}
+	plans := make(map[string]bool)
+	for i, plan := range c.Plans {
+		if plan.Name == "" {
+			return fmt.Errorf("plans[%d]: name is required", i)
+		}
+		if plans[plan.Name] {
+			return fmt.Errorf("plans[%d]: duplicate plan %q", i, plan.Name)
+		}
+		if !clusters[plan.Cluster] {
+			return fmt.Errorf("plans[%d]: plan %q uses unknown cluster %q", i, plan.Name, plan.Cluster)
+		}
+		if s := plan.Sharding; !s.Enabled && (s.PrimaryShard != "" || s.Zone != "") {
+			return fmt.Errorf("plans[%d].sharding: enabled must be true to pick the primary shard", i)
+		}
+		if s := plan.Sharding; s.PrimaryShard != "" && s.Zone != "" {
+			return fmt.Errorf("plans[%d].sharding: primary-shard and zone can't be set together", i)
+		}
+		if plan.MaxInstances < 0 {
+			return fmt.Errorf("plans[%d]: max-instances can't be negative", i)
+		}
+		for _, options := range []map[string]string{plan.Options, plan.ReadOptions} {
+			for key := range options {
+				if reservedOptions[key] {
+					return fmt.Errorf("plans[%d]: option %q is set by the service", i, key)
+				}
+			}
+		}
+		plans[plan.Name] = true
+	}
+	return nil
+}
+
+func (c *clusterTLSConfig) validate() error {
+	if !c.Enabled {
+		if c.CAFile != "" || c.CertFile != "" || c.Insecure || c.X509Auth {
+			return fmt.Errorf("enabled must be true to use the other TLS settings")
+		}
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert-file and key-file must be set together")
+	}
+	if c.X509Auth && c.CertFile == "" {
+		return fmt.Errorf("x509-auth requires cert-file and key-file")
+	}
+	return nil
+}
+
+func (c *clusterX509Config) enabled() bool {
+	return c.CACertFile != "" || c.CAKeyFile != ""
+}
+
+func (c *clusterX509Config) validate(tls clusterTLSConfig) error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.CACertFile == "" || c.CAKeyFile == "" {
+		return fmt.Errorf("ca-cert-file and ca-key-file must be set together")
+	}
+	if !tls.Enabled {
+		return fmt.Errorf("client certificates require tls to be enabled")
+	}
+	if c.Validity < 0 {
+		return fmt.Errorf("validity must be positive")
+	}
+	return nil
+}
+
+// validateSeedlist checks that drivers accept the public hosts of the cluster
+// as the targets of its seedlist, which must be in the parent domain of the
+// seedlist name.
+func (c *clusterConfig) validateSeedlist() error {
+	if c.Seedlist == "" {
+		return nil
+	}
+	if strings.HasPrefix(c.PublicURI, connSRVScheme) {
+		return fmt.Errorf("seedlist can't be used with a mongodb+srv:// public-uri")
+	}
+	parts := strings.SplitN(c.Seedlist, ".", 2)
+	if len(parts) < 2 || strings.Count(parts[1], ".") < 1 {
+		return fmt.Errorf("seedlist %q must have at least three labels", c.Seedlist)
+	}
+	// discovered hosts are only known at runtime.
+	hosts := strings.Split(c.PublicURI, ",")
+	if c.Discover {
+		hosts = hosts[:0]
+		for _, host := range c.HostMap {
+			hosts = append(hosts, host)
+		}
+	}
+	for _, member := range seedlistMembers(hosts) {
+		if !strings.HasSuffix(member.host, "."+parts[1]) {
+			return fmt.Errorf("public host %q is not in the domain of seedlist %q", member.host, c.Seedlist)
+		}
+	}
+	return nil
+}
+
+// seedlistCluster returns the cluster with the given seedlist name.
+func (c *config) seedlistCluster(name string) (clusterConfig, bool) {
+	for _, cluster := range c.Clusters {
+		if cluster.Seedlist != "" && strings.EqualFold(cluster.Seedlist, name) {
+			return cluster, true
+		}
+	}
+	return clusterConfig{}, false
+}
+
+// authMechanism returns the mechanism used by bound apps to authenticate in
+// the cluster. SCRAM-SHA-1 is the default, as it's the only one supported by
+// servers older than 4.0.
+func (c clusterConfig) authMechanism() string {
+	if c.X509.enabled() {
+		return "MONGODB-X509"
+	}
+	if c.AuthMechanism == "" {
+		return "SCRAM-SHA-1"
+	}
+	return c.AuthMechanism
+}
+
+// reservedOptions are the connection string options that plans can't set,
+// because they depend on the cluster or on the bind.
+var reservedOptions = map[string]bool{
+	"authSource":    true,
+	"authMechanism": true,
+	"replicaSet":    true,
+	"appName":       true,
+}
+
+// options returns the connection string options of the plan, sorted by key.
+func (p planConfig) options() []connOption {
+	return sortedOptions(p.Options)
+}
+
+// readOptions returns the connection string options of read-only binds of
+// the plan, sorted by key.
+func (p planConfig) readOptions() []connOption {
+	if len(p.ReadOptions) == 0 {
+		return []connOption{{Key: "readPreference", Value: "secondaryPreferred"}}
+	}
+	return sortedOptions(p.ReadOptions)
+}
+
+func sortedOptions(m map[string]string) []connOption {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	options := make([]connOption, len(keys))
+	for i, key := range keys {
+		options[i] = connOption{Key: key, Value: m[key]}
+	}
+	return options
+}
+
+// connKey identifies the settings used to connect to the cluster, so a new
+// client connects when they change.
+func (c clusterConfig) connKey() string {
+	return fmt.Sprintf("%s %+v", c.URI, c.TLS)
+}
+
+// plan returns the plan with the given name. The empty name is the default
+// plan, which is the first one in the config.
+func (c *config) plan(name string) (planConfig, bool) {
+	if name == "" && len(c.Plans) > 0 {
+		return c.Plans[0], true
+	}
+	for _, plan := range c.Plans {
+		if plan.Name == name {
+			return plan, true
+		}
+	}
+	return planConfig{}, false
+}
+
+// cluster returns the cluster with the given name. The empty name is the
+// default cluster, which is the first one in the config.
+func (c *config) cluster(name string) (clusterConfig, bool) {
+	if name == "" {
+		return c.Clusters[0], true
+	}
+	for _, cluster := range c.Clusters {
+		if cluster.Name == name {
+			return cluster, true
+		}
+	}
+	return clusterConfig{}, false
+}
+
+// planCluster returns the cluster where instances of the given plan are
+// created, falling back to the default cluster for unknown plans and for the
+// empty plan of instances created before plans were configured.
+func (c *config) planCluster(plan string) clusterConfig {
+	if plan == "" {
+		return c.Clusters[0]
+	}
+	if p, ok := c.plan(plan); ok {
+		if cluster, ok := c.cluster(p.Cluster); ok {
+			return cluster
+		}
+	}
+	return c.Clusters[0]
+}
+
+// instanceCluster returns the cluster that hosts the given instance: the one
+// recorded when it was created, or the one of its plan for instances created
+// before clusters were recorded. It returns false when the recorded cluster
+// is no longer in the config, as no other cluster hosts the instance.
+func (c *config) instanceCluster(instance dbInstance) (clusterConfig, bool) {
+	if instance.Cluster != "" {
+		return c.cluster(instance.Cluster)
+	}
+	return c.planCluster(instance.Plan), true
+}
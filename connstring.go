@@ -0,0 +1,172 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	connScheme    = "mongodb://"
+	connSRVScheme = "mongodb+srv://"
+)
+
+// connString is a MongoDB connection string, as described in
+// https://docs.mongodb.com/manual/reference/connection-string/.
+type connString struct {
+	SRV      bool
+	Username string
+	Password string
+	Hosts    []string
+	Database string
+	Options  []connOption
+}
+
+// connOption is an option of a connection string. Options are kept in the
+// order they're set, so the connection strings are stable.
+type connOption struct {
+	Key   string
+	Value string
+}
+
+// setHosts sets the hosts of the connection string from a list in the format
+// host1:port1,host2:port2, or from a mongodb+srv:// URI with the name used to
+// look up the hosts.
+func (c *connString) setHosts(hosts string) {
+	c.SRV = strings.HasPrefix(hosts, connSRVScheme)
+	hosts = strings.TrimPrefix(hosts, connSRVScheme)
+	c.Hosts = strings.Split(hosts, ",")
+}
+
+// get returns the value of the given option, or "" when it's not set.
+func (c *connString) get(key string) string {
+	for _, o := range c.Options {
+		if o.Key == key {
+			return o.Value
+		}
+	}
+	return ""
+}
+
+// set sets the value of the given option, replacing the current one.
+func (c *connString) set(key, value string) {
+	for i, o := range c.Options {
+		if o.Key == key {
+			c.Options[i].Value = value
+			return
+		}
+	}
+	c.Options = append(c.Options, connOption{Key: key, Value: value})
+}
+
+func (c *connString) String() string {
+	var buf strings.Builder
+	if c.SRV {
+		buf.WriteString(connSRVScheme)
+	} else {
+		buf.WriteString(connScheme)
+	}
+	if c.Username != "" {
+		buf.WriteString(connEscape(c.Username))
+		if c.Password != "" {
+			buf.WriteByte(':')
+			buf.WriteString(connEscape(c.Password))
+		}
+		buf.WriteByte('@')
+	}
+	buf.WriteString(strings.Join(c.Hosts, ","))
+	if c.Database != "" || len(c.Options) > 0 {
+		buf.WriteByte('/')
+		buf.WriteString(connEscape(c.Database))
+	}
+	for i, o := range c.Options {
+		if i == 0 {
+			buf.WriteByte('?')
+		} else {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(connEscape(o.Key))
+		buf.WriteByte('=')
+		buf.WriteString(connEscape(o.Value))
+	}
+	return buf.String()
+}
+
+// parseConnString parses a connection string in the format returned by
+// connString.String.
+func parseConnString(s string) (connString, error) {
+	var c connString
+	switch {
+	case strings.HasPrefix(s, connSRVScheme):
+		c.SRV = true
+		s = s[len(connSRVScheme):]
+	case strings.HasPrefix(s, connScheme):
+		s = s[len(connScheme):]
+	default:
+		return c, fmt.Errorf("invalid connection string: scheme must be mongodb:// or mongodb+srv://")
+	}
+	var rest string
+	if i := strings.IndexAny(s, "/?"); i >= 0 {
+		s, rest = s[:i], s[i:]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		var userInfo string
+		userInfo, s = s[:i], s[i+1:]
+		username, password := userInfo, ""
+		if j := strings.Index(userInfo, ":"); j >= 0 {
+			username, password = userInfo[:j], userInfo[j+1:]
+		}
+		var err error
+		if c.Username, err = url.PathUnescape(username); err != nil {
+			return c, fmt.Errorf("invalid connection string: %s", err)
+		}
+		if c.Password, err = url.PathUnescape(password); err != nil {
+			return c, fmt.Errorf("invalid connection string: %s", err)
+		}
+	}
+	if s == "" {
+		return c, fmt.Errorf("invalid connection string: missing hosts")
+	}
+	c.Hosts = strings.Split(s, ",")
+	if c.SRV && len(c.Hosts) > 1 {
+		return c, fmt.Errorf("invalid connection string: mongodb+srv:// requires a single host")
+	}
+	rest = strings.TrimPrefix(rest, "/")
+	var query string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	var err error
+	if c.Database, err = url.PathUnescape(rest); err != nil {
+		return c, fmt.Errorf("invalid connection string: %s", err)
+	}
+	if query == "" {
+		return c, nil
+	}
+	for _, pair := range strings.Split(query, "&") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return c, fmt.Errorf("invalid connection string: invalid option %q", pair)
+		}
+		key, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return c, fmt.Errorf("invalid connection string: %s", err)
+		}
+		value, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return c, fmt.Errorf("invalid connection string: %s", err)
+		}
+		c.set(key, value)
+	}
+	return c, nil
+}
+
+// connEscape escapes s for use in any part of a connection string. Unlike
+// url.QueryEscape, it keeps "+" meaning "+".
+func connEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxNameLength is the maximum length of the name of an instance.
+	maxNameLength = 100
+	// maxDatabaseLength is the maximum length of a database name in MongoDB.
+	maxDatabaseLength = 63
+	// uniqueSuffixLength is the length of the suffix added to database names
+	// already in use, including the separator.
+	uniqueSuffixLength = 7
+)
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+var errNoDatabaseName = errors.New("failed to find a database name that's not in use")
+
+var (
+	errReservedName   = &httpError{code: http.StatusForbidden, kind: "reserved-name", body: "Reserved name"}
+	errInstanceExists = &httpError{code: http.StatusConflict, kind: "instance-exists", body: "Instance already exists"}
+)
+
+// systemDatabases are the databases used by MongoDB itself.
+var systemDatabases = []string{"admin", "local", "config"}
+
+// reservedName tells whether the given name can't be used by instances: the
+// system databases, the database of the service metadata and the
+// reserved-names in the config. Names are compared ignoring case, like
+// MongoDB does with database names.
+func reservedName(ctx context.Context, name string) bool {
+	name = strings.ToLower(name)
+	for _, db := range systemDatabases {
+		if name == db {
+			return true
+		}
+	}
+	conf := contextConfig(ctx)
+	if name == strings.ToLower(conf.Metadata.Database) {
+		return true
+	}
+	for _, pattern := range conf.ReservedNames {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validName tells whether the given instance name is accepted by Add.
+func validName(name string) bool {
+	return len(name) <= maxNameLength && nameRegexp.MatchString(name)
+}
+
+// newDatabaseName returns the name of the database of a new instance in the
+// given cluster. The name of the instance is used when it's a valid database
+// name not in use by other instances or in the cluster, which may be shared
+// by other tsuru pools. Otherwise, it's made valid and unique.
+func newDatabaseName(ctx context.Context, cluster clusterConfig, name string) (string, error) {
+	// dots separate the database from the collection in namespaces.
+	candidate := strings.Replace(name, ".", "_", -1)
+	base := candidate
+	if len(base) > maxDatabaseLength-uniqueSuffixLength {
+		base = base[:maxDatabaseLength-uniqueSuffixLength]
+	}
+	if len(candidate) > maxDatabaseLength {
+		candidate = base + "_" + newPassword()[:uniqueSuffixLength-1]
+	}
+	for i := 0; i < 5; i++ {
+		used, err := databaseInUse(ctx, cluster, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return candidate, nil
+		}
+		candidate = base + "_" + newPassword()[:uniqueSuffixLength-1]
+	}
+	return "", errNoDatabaseName
+}
+
+// databaseInUse tells whether the given database name is reserved, or used by
+// other instances or in the cluster. Names are compared ignoring case, like
+// MongoDB does.
+func databaseInUse(ctx context.Context, cluster clusterConfig, db string) (bool, error) {
+	if reservedName(ctx, db) {
+		return true, nil
+	}
+	instances, err := getStore().ListInstances(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, instance := range instances {
+		if strings.EqualFold(instance.database(), db) {
+			return true, nil
+		}
+	}
+	return newCluster(cluster).DatabaseExists(ctx, db)
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidName(c *check.C) {
+	c.Check(validName("myapp"), check.Equals, true)
+	c.Check(validName("my-app.prod_1"), check.Equals, true)
+	c.Check(validName(strings.Repeat("a", maxNameLength)), check.Equals, true)
+	c.Check(validName(""), check.Equals, false)
+	c.Check(validName("-myapp"), check.Equals, false)
+	c.Check(validName("my app"), check.Equals, false)
+	c.Check(validName("my/app"), check.Equals, false)
+	c.Check(validName("my$app"), check.Equals, false)
+	c.Check(validName(strings.Repeat("a", maxNameLength+1)), check.Equals, false)
+}
+
+func (s *S) TestReservedName(c *check.C) {
+	s.conf.ReservedNames = []string{"tsuru-*", "Backup"}
+	for _, name := range []string{"admin", "Local", "CONFIG", dbName(), "tsuru-metrics", "TSURU-logs", "backup"} {
+		c.Check(reservedName(context.Background(), name), check.Equals, true, check.Commentf(name))
+	}
+	for _, name := range []string{"myapp", "administrator", "tsuru", "backups"} {
+		c.Check(reservedName(context.Background(), name), check.Equals, false, check.Commentf(name))
+	}
+}
+
+func (s *S) TestAddReservedNames(c *check.C) {
+	s.conf.ReservedNames = []string{"tsuru-*"}
+	for _, name := range []string{"admin", "local", "Config", "tsuru-metrics"} {
+		recorder := s.add(c, name, "")
+		c.Check(recorder.Code, check.Equals, http.StatusForbidden)
+		c.Check(recorder.Body.String(), check.Equals, jsonError("reserved-name", "Reserved name"))
+	}
+	c.Assert(s.store.instances, check.HasLen, 0)
+}
+
+func (s *S) TestBindReservedName(c *check.C) {
+	request, err := http.NewRequest("POST", "/resources/admin/bind-app", strings.NewReader("app-host=localhost"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("reserved-name", "Reserved name"))
+	c.Assert(s.cluster.users, check.HasLen, 0)
+	c.Assert(s.store.binds, check.HasLen, 0)
+}
+
+func (s *S) TestUnbindReservedName(c *check.C) {
+	s.store.AddBind(context.Background(), dbBind{Name: "local", AppHost: "localhost", User: "someone"})
+	request, err := http.NewRequest("DELETE", "/resources/local/bind-app", strings.NewReader("app-host=localhost"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(s.store.binds, check.HasLen, 1)
+}
+
+func (s *S) TestRemoveReservedName(c *check.C) {
+	request, err := http.NewRequest("DELETE", "/resources/admin", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("reserved-name", "Reserved name"))
+	c.Assert(s.cluster.dropped, check.HasLen, 0)
+}
+
+func (s *S) TestNewDatabaseName(c *check.C) {
+	db, err := newDatabaseName(context.Background(), clusterConfig{}, "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(db, check.Equals, "myapp")
+	db, err = newDatabaseName(context.Background(), clusterConfig{}, "my.app")
+	c.Assert(err, check.IsNil)
+	c.Assert(db, check.Equals, "my_app")
+}
+
+func (s *S) TestNewDatabaseNameTooLong(c *check.C) {
+	name := strings.Repeat("a", maxNameLength)
+	db, err := newDatabaseName(context.Background(), clusterConfig{}, name)
+	c.Assert(err, check.IsNil)
+	c.Assert(db, check.HasLen, maxDatabaseLength)
+	c.Assert(db, check.Matches, strings.Repeat("a", maxDatabaseLength-uniqueSuffixLength)+"_[0-9a-f]{6}")
+}
+
+func (s *S) TestNewDatabaseNameInUse(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "my.app", Database: "my_app"})
+	s.store.AddInstance(context.Background(), dbInstance{Name: "Legacy"})
+	s.cluster.databases = []string{"other"}
+	for _, name := range []string{"my_app", "legacy", "other", dbName()} {
+		db, err := newDatabaseName(context.Background(), clusterConfig{}, name)
+		c.Check(err, check.IsNil)
+		c.Check(db, check.Matches, name+"_[0-9a-f]{6}")
+	}
+}
+
+func (s *S) TestNewDatabaseNameFailure(c *check.C) {
+	s.cluster.fail("DatabaseExists", errors.New("not authorized on admin"))
+	_, err := newDatabaseName(context.Background(), clusterConfig{}, "myapp")
+	c.Assert(err, check.ErrorMatches, "not authorized on admin")
+}
+
+func (s *S) TestAddInvalidName(c *check.C) {
+	recorder := s.add(c, "my%2Fapp", "")
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "Invalid name"))
+	c.Assert(s.store.instances, check.HasLen, 0)
+}
+
+func (s *S) TestAddMapsTheDatabaseName(c *check.C) {
+	s.cluster.databases = []string{"my_app"}
+	c.Assert(s.add(c, "my.app", "").Code, check.Equals, http.StatusCreated)
+	instance, err := s.store.GetInstance(context.Background(), "my.app")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Database, check.Matches, "my_app_[0-9a-f]{6}")
+}
+
+func (s *S) TestBindAndRemoveUseTheDatabaseName(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "my.app", Database: "my_app"})
+	request, err := http.NewRequest("POST", "/resources/my.app/bind-app", strings.NewReader("app-host=localhost"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	data := map[string]string{}
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&data), check.IsNil)
+	c.Assert(data["MONGODB_DATABASE_NAME"], check.Equals, "my_app")
+	c.Assert(data["MONGODB_CONNECTION_STRING"], check.Matches, `mongodb://.*/my_app\?authSource=my_app&.*`)
+	c.Assert(s.cluster.password("my_app", data["MONGODB_USER"]), check.Equals, data["MONGODB_PASSWORD"])
+	request, err = http.NewRequest("DELETE", "/resources/my.app/bind-app", strings.NewReader("app-host=localhost"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(s.cluster.password("my_app", data["MONGODB_USER"]), check.Equals, "")
+	request, err = http.NewRequest("DELETE", "/resources/my.app", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(s.cluster.dropped, check.DeepEquals, []string{"my_app"})
+}
@@ -5,37 +5,306 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	mongotopology "go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
-var sess *mgo.Session
+// dialTimeout is the timeout for connecting to a cluster and selecting a
+// server in it.
+const dialTimeout = 10 * time.Second
 
-func session() (s *mgo.Session) {
-	var connect = func() *mgo.Session {
-		var err error
-		uri := coalesceEnv("MONGODB_URI", "127.0.0.1:27017")
-		session, err := mgo.Dial(uri)
+var (
+	// breakerThreshold is the number of consecutive failures to reach a
+	// cluster after which operations in it fail right away, without waiting
+	// for the dialTimeout.
+	breakerThreshold = 3
+	// minBackoff and maxBackoff bound the time the breaker of a cluster
+	// stays open before letting an operation through to probe it. The time
+	// doubles each time the probe fails.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+var (
+	conns    = make(map[string]*clusterConn)
+	connsMut sync.Mutex
+)
+
+// clusterConn manages the client of a cluster, along with a circuit breaker
+// that stops sending operations to the cluster while it can't be reached.
+type clusterConn struct {
+	name string
+
+	mut      sync.Mutex
+	client   *mongo.Client
+	failures int
+	backoff  time.Duration
+	retryAt  time.Time
+	probing  bool
+	lastErr  error
+}
+
+// getConn returns the connection manager of the given cluster, creating it on
+// first use.
+func getConn(c clusterConfig) *clusterConn {
+	key := c.connKey()
+	connsMut.Lock()
+	defer connsMut.Unlock()
+	conn := conns[key]
+	if conn == nil {
+		conn = &clusterConn{name: c.Name}
+		conns[key] = conn
+	}
+	return conn
+}
+
+// clusterClient returns the client of the given cluster, creating it on first
+// use. Clients keep a pool of connections to the cluster, reconnect to its
+// servers as needed and are safe for concurrent use, so requests share them,
+// each with its own context.
+func clusterClient(c clusterConfig) (*mongo.Client, error) {
+	return getConn(c).getClient(c)
+}
+
+func (conn *clusterConn) getClient(c clusterConfig) (*mongo.Client, error) {
+	conn.mut.Lock()
+	defer conn.mut.Unlock()
+	if conn.client != nil {
+		return conn.client, nil
+	}
+	opts, err := clientOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	conn.client = client
+	return client, nil
+}
+
+// allow reports whether an operation may be sent to the cluster. While the
+// breaker is open, only one operation is let through after the backoff, to
+// probe the cluster.
+func (conn *clusterConn) allow() bool {
+	conn.mut.Lock()
+	defer conn.mut.Unlock()
+	if conn.failures < breakerThreshold {
+		return true
+	}
+	if conn.probing || time.Now().Before(conn.retryAt) {
+		return false
+	}
+	conn.probing = true
+	return true
+}
+
+// done records the outcome of an operation allowed by allow. Failures to
+// reach the cluster open the breaker once they reach the breakerThreshold,
+// any other outcome closes it.
+func (conn *clusterConn) done(err error, cause error) {
+	conn.mut.Lock()
+	defer conn.mut.Unlock()
+	conn.probing = false
+	if err != errClusterUnavailable {
+		if conn.failures >= breakerThreshold {
+			log.Printf("cluster %q is available again", conn.name)
+		}
+		conn.failures = 0
+		conn.backoff = 0
+		conn.lastErr = nil
+		return
+	}
+	conn.failures++
+	conn.lastErr = cause
+	if conn.failures < breakerThreshold {
+		return
+	}
+	if conn.backoff == 0 {
+		conn.backoff = minBackoff
+	} else if conn.backoff *= 2; conn.backoff > maxBackoff {
+		conn.backoff = maxBackoff
+	}
+	conn.retryAt = time.Now().Add(conn.backoff)
+	log.Printf("cluster %q is unavailable, retrying in %s: %s", conn.name, conn.backoff, cause)
+}
+
+// ready returns the error that opened the breaker of the cluster, or nil
+// when it's closed.
+func (conn *clusterConn) ready() error {
+	conn.mut.Lock()
+	defer conn.mut.Unlock()
+	if conn.failures < breakerThreshold {
+		return nil
+	}
+	return fmt.Errorf("unavailable after %d failures: %s", conn.failures, conn.lastErr)
+}
+
+// clusterReady returns an error when operations in the given cluster are
+// failing because it can't be reached.
+func clusterReady(c clusterConfig) error {
+	return getConn(c).ready()
+}
+
+var (
+	// errTimeout is returned by operations that don't finish within the
+	// operation-timeout in the config, or before the deadline of their
+	// context.
+	errTimeout = &httpError{code: http.StatusGatewayTimeout, kind: "timeout", body: "Timed out waiting for MongoDB"}
+	// errClusterUnavailable is returned by operations in clusters that
+	// can't be reached.
+	errClusterUnavailable = &httpError{code: http.StatusServiceUnavailable, kind: "cluster-unavailable", body: "MongoDB is unavailable"}
+)
+
+// withClient runs op with the client of the given cluster, and a context
+// derived from ctx that expires after the operation-timeout in the config.
+// Timeouts are returned as errTimeout, and connection failures as
+// errClusterUnavailable, which is also returned right away while the breaker
+// of the cluster is open.
+func withClient(ctx context.Context, c clusterConfig, op func(context.Context, *mongo.Client) error) error {
+	if err := ctx.Err(); err != nil {
+		return opError(err)
+	}
+	conn := getConn(c)
+	client, err := conn.getClient(c)
+	if err != nil {
+		return err
+	}
+	if !conn.allow() {
+		return errClusterUnavailable
+	}
+	ctx, cancel := context.WithTimeout(ctx, contextConfig(ctx).OperationTimeout)
+	defer cancel()
+	cause := op(ctx, client)
+	err = opError(cause)
+	conn.done(err, cause)
+	return err
+}
+
+// opError translates the errors of operations in clusters that can't be
+// reached into errClusterUnavailable, and the ones of timed out operations
+// into errTimeout.
+func opError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.As(err, &mongotopology.ServerSelectionError{}) || mongo.IsNetworkError(err) && !mongo.IsTimeout(err) {
+		log.Printf("MongoDB is unavailable: %s", err)
+		return errClusterUnavailable
+	}
+	if mongo.IsTimeout(err) {
+		return errTimeout
+	}
+	return err
+}
+
+// clientOptions returns the options of the client of the given cluster,
+// connecting over TLS and authenticating with the client certificate when
+// configured.
+func clientOptions(c clusterConfig) (*options.ClientOptions, error) {
+	opts := options.Client().
+		ApplyURI(clientURI(c.URI)).
+		SetConnectTimeout(dialTimeout).
+		SetServerSelectionTimeout(dialTimeout)
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if !c.TLS.Enabled {
+		return opts, nil
+	}
+	tlsConf, err := c.TLS.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts.SetTLSConfig(tlsConf)
+	if c.TLS.X509Auth {
+		// the server takes the username from the subject of the
+		// certificate, in its own RFC 2253 form.
+		opts.SetAuth(options.Credential{
+			AuthMechanism: "MONGODB-X509",
+			AuthSource:    externalDB,
+		})
+	}
+	return opts, nil
+}
+
+// clientURI returns the given URI of a cluster as a connection string, as
+// URIs in the config may omit the mongodb:// scheme.
+func clientURI(uri string) string {
+	if strings.HasPrefix(uri, "mongodb://") || strings.HasPrefix(uri, "mongodb+srv://") {
+		return uri
+	}
+	return "mongodb://" + uri
+}
+
+// clientConfig returns the TLS config used to connect to the cluster.
+func (c clusterTLSConfig) clientConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to load the cluster CA: %s", err)
 		}
-		return session
+		conf.RootCAs = pool
 	}
-	if sess == nil {
-		sess = connect()
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the cluster client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			sess = connect()
-			s = sess
+	return conf, nil
+}
+
+// closeClients disconnects the clients with the given keys, so they connect
+// again, with their breakers closed, on next use.
+func closeClients(keys []string) {
+	connsMut.Lock()
+	defer connsMut.Unlock()
+	for _, key := range keys {
+		if conn := conns[key]; conn != nil {
+			conn.close()
+			delete(conns, key)
 		}
-	}()
-	err := sess.Ping()
-	if err != nil {
-		sess = connect()
 	}
-	return sess
+}
+
+// closeAllClients disconnects the clients of every cluster.
+func closeAllClients() {
+	connsMut.Lock()
+	defer connsMut.Unlock()
+	for key, conn := range conns {
+		conn.close()
+		delete(conns, key)
+	}
+}
+
+func (conn *clusterConn) close() {
+	conn.mut.Lock()
+	defer conn.mut.Unlock()
+	if conn.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if err := conn.client.Disconnect(ctx); err != nil {
+		log.Printf("failed to disconnect from cluster %q: %s", conn.name, err)
+	}
+	conn.client = nil
 }
 
 // coalesceEnv returns the value of the first environment variable in the list
@@ -55,9 +324,5 @@ func coalesceEnv(envs ...string) string {
 }
 
 func dbName() string {
-	return coalesceEnv("MONGOAPI_DBNAME", "mongoapi")
-}
-
-func collection() *mgo.Collection {
-	return session().DB(dbName()).C("bind")
+	return currentConfig().Metadata.Database
 }
@@ -0,0 +1,475 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// faults holds errors injected in fake operations, keyed by method name.
+type faults struct {
+	mut    sync.Mutex
+	errors map[string]error
+}
+
+// fail makes the next calls to the given operation return err, until it's
+// called again with a nil error.
+func (f *faults) fail(op string, err error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.errors == nil {
+		f.errors = make(map[string]error)
+	}
+	f.errors[op] = err
+}
+
+func (f *faults) err(op string) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.errors[op]
+}
+
+// fakeCluster is an in-memory Cluster.
+type fakeCluster struct {
+	faults
+	mut     sync.Mutex
+	users   map[string]map[string]string
+	dropped []string
+	pings   int
+	members topology
+	// roles maps the users to their role.
+	roles map[string]string
+	// sharded maps the sharded databases to their primary shard.
+	sharded map[string]string
+	zones   map[string][]string
+	chunks  map[string]chunkDistribution
+	// databases are the databases that exist in the cluster, besides the
+	// ones with users.
+	databases []string
+	sizes     map[string]int64
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{
+		users:   make(map[string]map[string]string),
+		roles:   make(map[string]string),
+		sharded: make(map[string]string),
+		zones:   make(map[string][]string),
+		chunks:  make(map[string]chunkDistribution),
+		sizes:   make(map[string]int64),
+	}
+}
+
+func (f *fakeCluster) AddUser(ctx context.Context, db, username, password, role string) error {
+	if err := f.err("AddUser"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.roles[username] = role
+	if f.users[db] == nil {
+		f.users[db] = make(map[string]string)
+	}
+	f.users[db][username] = password
+	return nil
+}
+
+func (f *fakeCluster) AddX509User(ctx context.Context, db, subject, role string) error {
+	if err := f.err("AddX509User"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.roles[subject] = role
+	if f.users[externalDB] == nil {
+		f.users[externalDB] = make(map[string]string)
+	}
+	f.users[externalDB][subject] = db
+	return nil
+}
+
+func (f *fakeCluster) RemoveUser(ctx context.Context, db, username string) error {
+	if err := f.err("RemoveUser"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if _, ok := f.users[db][username]; !ok {
+		return errNotFound
+	}
+	delete(f.users[db], username)
+	return nil
+}
+
+func (f *fakeCluster) DropDatabase(ctx context.Context, db string) error {
+	if err := f.err("DropDatabase"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	delete(f.users, db)
+	f.dropped = append(f.dropped, db)
+	return nil
+}
+
+func (f *fakeCluster) Ping(ctx context.Context) error {
+	if err := f.err("Ping"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.pings++
+	return nil
+}
+
+func (f *fakeCluster) EnableSharding(ctx context.Context, db, primaryShard string) error {
+	if err := f.err("EnableSharding"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.sharded[db] = primaryShard
+	return nil
+}
+
+func (f *fakeCluster) ZoneShards(ctx context.Context, zone string) ([]string, error) {
+	if err := f.err("ZoneShards"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.zones[zone], nil
+}
+
+func (f *fakeCluster) ChunkDistribution(ctx context.Context, db string) (chunkDistribution, error) {
+	if err := f.err("ChunkDistribution"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.chunks[db], nil
+}
+
+func (f *fakeCluster) DatabaseExists(ctx context.Context, db string) (bool, error) {
+	if err := f.err("DatabaseExists"); err != nil {
+		return false, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if _, ok := f.users[db]; ok {
+		return true, nil
+	}
+	for _, name := range f.databases {
+		if name == db {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeCluster) Users(ctx context.Context, db string) ([]string, error) {
+	if err := f.err("Users"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var users []string
+	for user := range f.users[db] {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (f *fakeCluster) DatabaseSize(ctx context.Context, db string) (int64, error) {
+	if err := f.err("DatabaseSize"); err != nil {
+		return 0, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.sizes[db], nil
+}
+
+func (f *fakeCluster) Topology(ctx context.Context) (topology, error) {
+	if err := f.err("Topology"); err != nil {
+		return topology{}, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.members, nil
+}
+
+// password returns the password of the given user, or "" when the user
+// doesn't exist. For users in $external, it returns the database the user
+// has access to.
+func (f *fakeCluster) password(db, username string) string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.users[db][username]
+}
+
+// fakeStore is an in-memory Store.
+type fakeStore struct {
+	faults
+	mut         sync.Mutex
+	instances   []dbInstance
+	binds       []dbBind
+	audit       []auditEntry
+	revocations []dbRevocation
+	migrations  []dbMigration
+	locks       map[string]time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{locks: make(map[string]time.Time)}
+}
+
+func (f *fakeStore) AddInstance(ctx context.Context, instance dbInstance) error {
+	if err := f.err("AddInstance"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, existing := range f.instances {
+		if existing.Name == instance.Name {
+			return errInstanceExists
+		}
+	}
+	for _, existing := range f.instances {
+		if sameDatabase(existing, instance) {
+			return errDatabaseInUse
+		}
+	}
+	f.instances = append(f.instances, instance)
+	return nil
+}
+
+func (f *fakeStore) GetInstance(ctx context.Context, name string) (dbInstance, error) {
+	if err := f.err("GetInstance"); err != nil {
+		return dbInstance{}, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, instance := range f.instances {
+		if instance.Name == name {
+			return instance, nil
+		}
+	}
+	return dbInstance{}, errNotFound
+}
+
+func (f *fakeStore) ListInstances(ctx context.Context) ([]dbInstance, error) {
+	if err := f.err("ListInstances"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return append([]dbInstance(nil), f.instances...), nil
+}
+
+func (f *fakeStore) RemoveInstance(ctx context.Context, name string) error {
+	if err := f.err("RemoveInstance"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for i, instance := range f.instances {
+		if instance.Name == name {
+			f.instances = append(f.instances[:i], f.instances[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (f *fakeStore) AddBind(ctx context.Context, bind dbBind) error {
+	if err := f.err("AddBind"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, existing := range f.binds {
+		if existing.Name == bind.Name && existing.AppHost == bind.AppHost && existing.Kind == bind.Kind {
+			return errAlreadyBound
+		}
+	}
+	f.binds = append(f.binds, bind)
+	return nil
+}
+
+func (f *fakeStore) GetBind(ctx context.Context, name, appHost, kind string) (dbBind, error) {
+	if err := f.err("GetBind"); err != nil {
+		return dbBind{}, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, bind := range f.binds {
+		if bind.Name == name && bind.AppHost == appHost && bind.Kind == kind {
+			return bind, nil
+		}
+	}
+	return dbBind{}, errNotFound
+}
+
+func (f *fakeStore) ListAllBinds(ctx context.Context) ([]dbBind, error) {
+	if err := f.err("ListAllBinds"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return append([]dbBind(nil), f.binds...), nil
+}
+
+func (f *fakeStore) ListBinds(ctx context.Context, name string) ([]dbBind, error) {
+	if err := f.err("ListBinds"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var binds []dbBind
+	for _, bind := range f.binds {
+		if bind.Name == name {
+			binds = append(binds, bind)
+		}
+	}
+	return binds, nil
+}
+
+func (f *fakeStore) RemoveBind(ctx context.Context, bind dbBind) error {
+	if err := f.err("RemoveBind"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for i, b := range f.binds {
+		if b == bind {
+			f.binds = append(f.binds[:i], f.binds[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (f *fakeStore) RemoveBinds(ctx context.Context, name string) error {
+	if err := f.err("RemoveBinds"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var binds []dbBind
+	for _, bind := range f.binds {
+		if bind.Name != name {
+			binds = append(binds, bind)
+		}
+	}
+	f.binds = binds
+	return nil
+}
+
+func (f *fakeStore) AddAuditEntry(ctx context.Context, entry auditEntry) error {
+	if err := f.err("AddAuditEntry"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.audit = append(f.audit, entry)
+	return nil
+}
+
+func (f *fakeStore) ListAuditEntries(ctx context.Context, name string) ([]auditEntry, error) {
+	if err := f.err("ListAuditEntries"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var entries []auditEntry
+	for _, entry := range f.audit {
+		if entry.Instance == name {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (f *fakeStore) AddRevocation(ctx context.Context, revocation dbRevocation) error {
+	if err := f.err("AddRevocation"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, r := range f.revocations {
+		if r.Cluster == revocation.Cluster && r.Serial == revocation.Serial {
+			return nil
+		}
+	}
+	f.revocations = append(f.revocations, revocation)
+	return nil
+}
+
+func (f *fakeStore) ListRevocations(ctx context.Context, cluster string) ([]dbRevocation, error) {
+	if err := f.err("ListRevocations"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var revocations []dbRevocation
+	for _, revocation := range f.revocations {
+		if revocation.Cluster == cluster {
+			revocations = append(revocations, revocation)
+		}
+	}
+	return revocations, nil
+}
+
+func (f *fakeStore) AddMigration(ctx context.Context, migration dbMigration) error {
+	if err := f.err("AddMigration"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.migrations = append(f.migrations, migration)
+	return nil
+}
+
+func (f *fakeStore) ListMigrations(ctx context.Context) ([]dbMigration, error) {
+	if err := f.err("ListMigrations"); err != nil {
+		return nil, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	migrations := append([]dbMigration(nil), f.migrations...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (f *fakeStore) Lock(ctx context.Context, name string) (bool, error) {
+	if err := f.err("Lock"); err != nil {
+		return false, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if expires, ok := f.locks[name]; ok && expires.After(time.Now()) {
+		return false, nil
+	}
+	f.locks[name] = time.Now().Add(lockTTL)
+	return true, nil
+}
+
+func (f *fakeStore) Unlock(ctx context.Context, name string) error {
+	if err := f.err("Unlock"); err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	delete(f.locks, name)
+	return nil
+}
+
+func (f *fakeStore) Close() error {
+	return nil
+}
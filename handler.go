@@ -5,32 +5,123 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-
-	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"sync"
+	"time"
 )
 
-func Add(w http.ResponseWriter, r *http.Request) {
+// addLockPrefix is the prefix of the locks held while adding instances to a
+// cluster, which can't clash with instance names.
+const addLockPrefix = "$add/"
+
+func Add(w http.ResponseWriter, r *http.Request) error {
 	name := r.FormValue("name")
-	if name == dbName() {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Reserved name")
-		return
+	if reservedName(r.Context(), name) {
+		return errReservedName
+	}
+	if !validName(name) {
+		return badRequest("Invalid name")
+	}
+	planName := r.FormValue("plan")
+	conf := contextConfig(r.Context())
+	if len(conf.Plans) > 0 {
+		plan, ok := conf.plan(planName)
+		if !ok {
+			return badRequest("Invalid plan")
+		}
+		planName = plan.Name
+	}
+	ctx := r.Context()
+	cluster := conf.planCluster(planName)
+	// instances are added to each cluster one at a time, so concurrent
+	// requests can't pick the same database or exceed the quota of a plan.
+	if err := lock(ctx, addLockPrefix+cluster.Name); err != nil {
+		return err
+	}
+	defer unlock(ctx, addLockPrefix+cluster.Name)
+	if err := checkNewInstance(ctx, name, planName); err != nil {
+		return err
 	}
+	db, err := newDatabaseName(ctx, cluster, name)
+	if err != nil {
+		return err
+	}
+	instance := dbInstance{
+		Name:      name,
+		Plan:      planName,
+		Cluster:   cluster.Name,
+		Database:  db,
+		Team:      r.FormValue("team"),
+		CreatedAt: time.Now().UTC(),
+	}
+	if plan, _ := conf.plan(planName); plan.Sharding.Enabled {
+		primary, err := enableSharding(ctx, cluster, plan, db)
+		if err != nil {
+			return err
+		}
+		instance.Sharded, instance.PrimaryShard = true, primary
+	}
+	if err := getStore().AddInstance(ctx, instance); err != nil {
+		return err
+	}
+	audit(ctx, name, "add", "")
 	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// checkNewInstance returns errInstanceExists when the name is taken, and
+// errQuotaExceeded when the plan has reached its maximum number of
+// instances.
+func checkNewInstance(ctx context.Context, name, planName string) error {
+	store := getStore()
+	_, err := store.GetInstance(ctx, name)
+	if err == nil {
+		return errInstanceExists
+	}
+	if err != errNotFound {
+		return err
+	}
+	plan, _ := contextConfig(ctx).plan(planName)
+	if plan.MaxInstances == 0 {
+		return nil
+	}
+	instances, err := store.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, instance := range instances {
+		if instance.Plan == plan.Name {
+			count++
+		}
+	}
+	if count >= plan.MaxInstances {
+		return errQuotaExceeded
+	}
+	return nil
 }
 
 func BindApp(w http.ResponseWriter, r *http.Request) error {
 	name := r.URL.Query().Get(":name")
 	appHost := r.FormValue("app-host")
 	if appHost == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Missing app-host")
-		return nil
+		return badRequest("Missing app-host")
+	}
+	kind, ok := bindKind(r.FormValue("access"))
+	if !ok {
+		return errInvalidAccess
+	}
+	prefix, ok := envPrefix(r.FormValue("env-prefix"), name)
+	if !ok {
+		return badRequest("Invalid env-prefix, must be auto or a valid variable name")
 	}
-	env, err := bind(name, appHost)
+	env, err := bind(r.Context(), name, appHost, bindOptions{Kind: kind, EnvPrefix: prefix})
 	if err != nil {
 		return err
 	}
@@ -38,6 +129,17 @@ func BindApp(w http.ResponseWriter, r *http.Request) error {
 	return json.NewEncoder(w).Encode(env)
 }
 
+// bindKind returns the kind of bind for the given access parameter.
+func bindKind(access string) (string, bool) {
+	switch access {
+	case "", "read-write":
+		return readWriteBind, true
+	case "read":
+		return readBind, true
+	}
+	return "", false
+}
+
 func BindUnit(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
@@ -46,7 +148,15 @@ func UnbindApp(w http.ResponseWriter, r *http.Request) error {
 	r.Method = "POST"
 	name := r.URL.Query().Get(":name")
 	appHost := r.FormValue("app-host")
-	err := unbind(name, appHost)
+	var kind *string
+	if access := r.FormValue("access"); access != "" {
+		k, ok := bindKind(access)
+		if !ok {
+			return errInvalidAccess
+		}
+		kind = &k
+	}
+	err := unbind(r.Context(), name, appHost, kind)
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -59,40 +169,371 @@ func UnbindUnit(w http.ResponseWriter, r *http.Request) error {
 
 func Remove(w http.ResponseWriter, r *http.Request) error {
 	name := r.URL.Query().Get(":name")
-	collection().RemoveAll(bson.M{"name": name})
-	err := session().DB(name).DropDatabase()
+	if reservedName(r.Context(), name) {
+		return errReservedName
+	}
+	ctx := r.Context()
+	if err := lock(ctx, name); err != nil {
+		return err
+	}
+	defer unlock(ctx, name)
+	instance, _, cluster, err := getInstance(ctx, name)
+	if err != nil {
+		return err
+	}
+	db := instance.database()
+	store := getStore()
+	binds, err := store.ListBinds(ctx, name)
 	if err != nil {
 		return err
 	}
+	// dropping the database doesn't remove the users in $external. Users
+	// already removed by a failed attempt are ignored.
+	for _, bind := range binds {
+		if bind.CertSerial != "" {
+			if err := removeUser(ctx, cluster, db, bind); err != nil && err != errNotFound {
+				return err
+			}
+		}
+	}
+	// the records are kept until the database is dropped, so a failed
+	// attempt can be retried with the same database and cluster.
+	if err := newCluster(cluster).DropDatabase(ctx, db); err != nil {
+		return err
+	}
+	if err := store.RemoveBinds(ctx, name); err != nil {
+		return err
+	}
+	// instances created before the store was introduced don't have a record.
+	if err := store.RemoveInstance(ctx, name); err != nil && err != errNotFound {
+		return err
+	}
+	audit(ctx, name, "remove", "")
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
 func Status(w http.ResponseWriter, r *http.Request) error {
-	if err := session().Ping(); err != nil {
+	cluster, err := instanceCluster(r.Context(), r.URL.Query().Get(":name"))
+	if err != nil {
+		return err
+	}
+	if err := newCluster(cluster).Ping(r.Context()); err != nil {
 		return err
 	}
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+// CRL serves the list of client certificates revoked in the given cluster,
+// in DER.
+func CRL(w http.ResponseWriter, r *http.Request) error {
+	cluster, ok := contextConfig(r.Context()).cluster(r.URL.Query().Get(":cluster"))
+	if !ok || !cluster.X509.enabled() {
+		return &httpError{code: http.StatusNotFound, kind: "cluster-not-found", body: "Cluster not found"}
+	}
+	ca, err := loadCertAuthority(cluster.X509)
+	if err != nil {
+		return err
+	}
+	revocations, err := getStore().ListRevocations(r.Context(), cluster.Name)
+	if err != nil {
+		return err
+	}
+	crl, err := ca.crl(revocations)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	_, err = w.Write(crl)
+	return err
+}
+
+type infoItem struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Info describes the instance to tsuru users: its plan, its database and, for
+// sharded databases, the distribution of chunks of its collections.
+func Info(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instance, plan, cluster, err := getInstance(ctx, r.URL.Query().Get(":name"))
+	if err != nil {
+		return err
+	}
+	info := []infoItem{
+		{Label: "Cluster", Value: cluster.Name},
+		{Label: "Database", Value: instance.database()},
+	}
+	if plan.Name != "" {
+		info = append(info, infoItem{Label: "Plan", Value: plan.Name})
+	}
+	if instance.Sharded {
+		value := "enabled"
+		if instance.PrimaryShard != "" {
+			value += ", primary shard " + instance.PrimaryShard
+		}
+		info = append(info, infoItem{Label: "Sharding", Value: value})
+		chunks, err := newCluster(cluster).ChunkDistribution(ctx, instance.database())
+		if err != nil {
+			return err
+		}
+		for _, coll := range chunks.collections() {
+			info = append(info, infoItem{Label: "Chunks of " + coll, Value: chunks.format(coll)})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(info)
+}
+
+type instanceItem struct {
+	Name     string `json:"name"`
+	Team     string `json:"team"`
+	Plan     string `json:"plan"`
+	Cluster  string `json:"cluster"`
+	Database string `json:"database"`
+	// Size is -1 when it can't be read from the cluster.
+	Size  int64 `json:"size"`
+	Binds int   `json:"binds"`
+}
+
+// unknownSize is the size of instances whose cluster failed to report it.
+const unknownSize = -1
+
+// List lists the instances, with their size and number of binds, for the
+// operators of the service. The team parameter restricts the list to the
+// instances of the given team.
+func List(w http.ResponseWriter, r *http.Request) error {
+	items, err := listInstances(r.Context(), r.FormValue("team"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(items)
+}
+
+// listInstances returns the instances of the given team, sorted by name. An
+// empty team returns all of them.
+func listInstances(ctx context.Context, team string) ([]instanceItem, error) {
+	store := getStore()
+	instances, err := store.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	conf := contextConfig(ctx)
+	items := []instanceItem{}
+	for _, instance := range instances {
+		if team != "" && instance.Team != team {
+			continue
+		}
+		binds, err := store.ListBinds(ctx, instance.Name)
+		if err != nil {
+			return nil, err
+		}
+		item := instanceItem{
+			Name:     instance.Name,
+			Team:     instance.Team,
+			Plan:     instance.Plan,
+			Cluster:  instance.Cluster,
+			Database: instance.database(),
+			Size:     unknownSize,
+			Binds:    len(binds),
+		}
+		// a cluster that's down or denies dbStats doesn't hide the other
+		// instances.
+		cluster, ok := conf.instanceCluster(instance)
+		if ok {
+			item.Cluster = cluster.Name
+			item.Size, err = newCluster(cluster).DatabaseSize(ctx, item.Database)
+		} else {
+			err = errInstanceClusterNotFound
+		}
+		if err != nil {
+			log.Printf("failed to get the size of %q: %s", instance.Name, err)
+			item.Size = unknownSize
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+type plan struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func Plans(w http.ResponseWriter, r *http.Request) error {
+	plans := []plan{}
+	for _, p := range contextConfig(r.Context()).Plans {
+		plans = append(plans, plan{Name: p.Name, Description: p.Description})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(plans)
+}
+
+// pinConfig makes each request use the config in use when it arrived, even
+// when the config is reloaded before the request finishes.
+func pinConfig(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withConfig(r.Context(), currentConfig())))
+	})
+}
+
+// withProbes serves the liveness and readiness probes, which don't require
+// credentials, as load balancers don't have them, and the API in h.
+func withProbes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			Handler(Healthz).ServeHTTP(w, r)
+		case "/readyz":
+			Handler(Readyz).ServeHTTP(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Healthz reports that the process is alive and serving requests, without
+// checking its dependencies.
+func Healthz(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte("WORKING"))
+	return err
+}
+
+// readiness is the body of Readyz, with the result of each check, which is
+// "ok" or the error that made it fail.
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Readyz reports whether the API can serve requests: the metadata store must
+// be reachable, with every migration applied, and every cluster must answer
+// to a ping. It responds with a 503 when any of them fails.
+func Readyz(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	clusters := contextConfig(ctx).Clusters
+	checks := make([]error, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		wg.Add(1)
+		go func(i int, cluster clusterConfig) {
+			defer wg.Done()
+			err := newCluster(cluster).Ping(ctx)
+			if err != nil {
+				// the breaker of the cluster has the cause of the failures.
+				if cause := clusterReady(cluster); cause != nil {
+					log.Printf("readiness check of cluster %q failed: %s", cluster.Name, cause)
+				}
+			}
+			checks[i] = err
+		}(i, cluster)
+	}
+	status := readiness{Ready: true, Checks: make(map[string]string)}
+	// the probe doesn't require credentials, so it only shows the messages
+	// of errors meant for users, like the ones of the API.
+	check := func(name string, err error) {
+		status.Checks[name] = "ok"
+		var e *httpError
+		if err != nil && !errors.As(err, &e) {
+			log.Printf("readiness check of %s failed: %s", name, err)
+			e = errInternal
+		}
+		if e != nil {
+			status.Checks[name] = e.body
+		}
+		status.Ready = status.Ready && err == nil
+	}
+	pending, err := pendingMigrations(ctx, getStore())
+	check("store", err)
+	if err == nil && len(pending) > 0 {
+		status.Checks["migrations"] = fmt.Sprintf("%d pending", len(pending))
+		status.Ready = false
+	} else if err == nil {
+		check("migrations", nil)
+	}
+	wg.Wait()
+	for i, cluster := range clusters {
+		check("cluster "+cluster.Name, checks[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(status)
+}
+
+// basicAuth requires the credentials in the auth section of the config from
+// every request, when they're set.
+func basicAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := contextConfig(r.Context()).Auth
+		if auth.Username != "" {
+			username, password, ok := r.BasicAuth()
+			if !ok || username != auth.Username || password != auth.Password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mongoapi"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 type Handler func(http.ResponseWriter, *http.Request) error
 
 func (fn Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil {
-		if e, ok := err.(*httpError); ok {
-			http.Error(w, e.body, e.code)
-		} else {
-			http.Error(w, err.Error(), 500)
-		}
+		writeError(w, r, err)
 	}
 }
 
+var errInternal = &httpError{code: http.StatusInternalServerError, kind: "internal-error", body: "Internal error"}
+
+// writeError writes the response of the given error, in JSON. Errors that
+// aren't an httpError are internal errors, with a 500: they're logged, as
+// their messages may carry details of the clusters that users shouldn't see.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *httpError
+	if !errors.As(err, &e) {
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		e = errInternal
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.code)
+	json.NewEncoder(w).Encode(errorBody{Error: e.kind, Message: e.body})
+}
+
+// httpError is an error with the status code of its response. The kind
+// identifies the error for clients, and the body describes it to users.
 type httpError struct {
 	code int
+	kind string
 	body string
 }
 
+// errorBody is the body of error responses.
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// badRequest returns the error of a request with the given invalid
+// parameter.
+func badRequest(body string) *httpError {
+	return &httpError{code: http.StatusBadRequest, kind: "bad-request", body: body}
+}
+
+var (
+	errInvalidAccess = badRequest("Invalid access, must be read or read-write")
+	errQuotaExceeded = &httpError{code: http.StatusForbidden, kind: "quota-exceeded", body: "The plan has reached its maximum number of instances"}
+)
+
 func (e *httpError) Error() string {
 	return fmt.Sprintf("HTTP error (%d): %s", e.code, e.body)
 }
@@ -5,49 +5,100 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var _ = check.Suite(&S{})
 
 type S struct {
-	muxer http.Handler
+	muxer      http.Handler
+	conf       *config
+	store      *fakeStore
+	cluster    *fakeCluster
+	newCluster func(clusterConfig) Cluster
 }
 
 func Test(t *testing.T) { check.TestingT(t) }
 
 func (s *S) SetUpSuite(c *check.C) {
 	s.muxer = buildMux()
+	s.newCluster = newCluster
 }
 
 func (s *S) TearDownSuite(c *check.C) {
-	session().DB(dbName()).DropDatabase()
+	newCluster = s.newCluster
 }
 
 func (s *S) SetUpTest(c *check.C) {
-	collection().RemoveAll(nil)
+	var err error
+	s.conf, err = loadConfig("")
+	c.Assert(err, check.IsNil)
+	setConfig(s.conf)
+	s.store = newFakeStore()
+	s.cluster = newFakeCluster()
+	currentStore = s.store
+	newCluster = func(clusterConfig) Cluster { return s.cluster }
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	currentStore = nil
+	setConfig(nil)
 }
 
 func (s *S) TestAdd(c *check.C) {
-	body := strings.NewReader("name=something")
+	body := strings.NewReader("name=something&plan=small&team=myteam")
 	request, err := http.NewRequest("POST", "/resources", body)
 	c.Assert(err, check.IsNil)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	instance, err := s.store.GetInstance(context.Background(), "something")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Plan, check.Equals, "small")
+	c.Assert(instance.Cluster, check.Equals, "default")
+	c.Assert(instance.Team, check.Equals, "myteam")
+	entries, err := s.store.ListAuditEntries(context.Background(), "something")
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].Action, check.Equals, "add")
+}
+
+func (s *S) TestAddStoreFailure(c *check.C) {
+	s.store.fail("AddInstance", errors.New("store is down"))
+	body := strings.NewReader("name=something")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+}
+
+func (s *S) TestAddStoreTimeout(c *check.C) {
+	s.store.fail("AddInstance", errTimeout)
+	body := strings.NewReader("name=something")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("timeout", "Timed out waiting for MongoDB"))
 }
 
 func (s *S) TestAddReservedName(c *check.C) {
@@ -59,22 +110,257 @@ func (s *S) TestAddReservedName(c *check.C) {
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
-	c.Assert(recorder.Body.String(), check.Equals, "Reserved name")
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("reserved-name", "Reserved name"))
+	c.Assert(s.store.instances, check.HasLen, 0)
+}
+
+func (s *S) TestAddWithInvalidPlan(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}}
+	body := strings.NewReader("name=something&plan=huge")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "Invalid plan"))
+	c.Assert(s.store.instances, check.HasLen, 0)
+}
+
+func (s *S) TestAddInstanceExists(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "something"})
+	body := strings.NewReader("name=something")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("instance-exists", "Instance already exists"))
+	c.Assert(s.store.instances, check.HasLen, 1)
+}
+
+func (s *S) TestAddQuotaExceeded(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default", MaxInstances: 1}, {Name: "large", Cluster: "default"}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "another", Plan: "small"})
+	add := func(params string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("POST", "/resources", strings.NewReader(params))
+		c.Assert(err, check.IsNil)
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.muxer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := add("name=something&plan=small")
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("quota-exceeded", "The plan has reached its maximum number of instances"))
+	recorder = add("name=something&plan=large")
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+}
+
+func (s *S) TestAddWithoutPlanUsesTheDefaultPlan(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}, {Name: "large", Cluster: "default"}}
+	body := strings.NewReader("name=something")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	instance, err := s.store.GetInstance(context.Background(), "something")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Plan, check.Equals, "small")
+	c.Assert(instance.Cluster, check.Equals, "default")
+}
+
+func (s *S) list(c *check.C, query string) []instanceItem {
+	request, err := http.NewRequest("GET", "/resources"+query, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var items []instanceItem
+	err = json.NewDecoder(recorder.Body).Decode(&items)
+	c.Assert(err, check.IsNil)
+	return items
+}
+
+func (s *S) TestList(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small", Team: "payments", Database: "myapp_db"})
+	s.store.AddInstance(context.Background(), dbInstance{Name: "another", Plan: "small", Team: "search"})
+	s.store.AddInstance(context.Background(), dbInstance{Name: "legacy"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1"})
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app2"})
+	s.cluster.sizes["myapp_db"] = 4096
+	c.Assert(s.list(c, "?team=payments"), check.DeepEquals, []instanceItem{
+		{Name: "myapp", Team: "payments", Plan: "small", Cluster: "default", Database: "myapp_db", Size: 4096, Binds: 2},
+	})
+	c.Assert(s.list(c, ""), check.DeepEquals, []instanceItem{
+		{Name: "another", Team: "search", Plan: "small", Cluster: "default", Database: "another"},
+		{Name: "legacy", Cluster: "default", Database: "legacy"},
+		{Name: "myapp", Team: "payments", Plan: "small", Cluster: "default", Database: "myapp_db", Size: 4096, Binds: 2},
+	})
+	c.Assert(s.list(c, "?team=unknown"), check.DeepEquals, []instanceItem{})
+}
+
+func (s *S) TestListDatabaseSizeFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Cluster: "default", Database: "myapp"})
+	s.store.AddInstance(context.Background(), dbInstance{Name: "removed", Cluster: "removed", Database: "removed"})
+	s.cluster.fail("DatabaseSize", errors.New("not authorized on myapp"))
+	request, err := http.NewRequest("GET", "/resources", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var items []instanceItem
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &items), check.IsNil)
+	c.Assert(items, check.DeepEquals, []instanceItem{
+		{Name: "myapp", Cluster: "default", Database: "myapp", Size: unknownSize},
+		{Name: "removed", Cluster: "removed", Database: "removed", Size: unknownSize},
+	})
+}
+
+func (s *S) TestPlans(c *check.C) {
+	s.conf.Plans = []planConfig{
+		{Name: "small", Description: "Shared cluster", Cluster: "default"},
+		{Name: "large", Description: "Dedicated cluster", Cluster: "default"},
+	}
+	request, err := http.NewRequest("GET", "/resources/plans", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var plans []plan
+	err = json.NewDecoder(recorder.Body).Decode(&plans)
+	c.Assert(err, check.IsNil)
+	c.Assert(plans, check.DeepEquals, []plan{
+		{Name: "small", Description: "Shared cluster"},
+		{Name: "large", Description: "Dedicated cluster"},
+	})
+}
+
+func (s *S) TestPlansEmpty(c *check.C) {
+	request, err := http.NewRequest("GET", "/resources/plans", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "[]\n")
+}
+
+func (s *S) TestBasicAuth(c *check.C) {
+	s.conf.Auth = authConfig{Username: "tsuru", Password: "secret"}
+	request, err := http.NewRequest("GET", "/resources/plans", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	request.SetBasicAuth("tsuru", "wrong")
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	request.SetBasicAuth("tsuru", "secret")
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestBindUsesThePlanCluster(c *check.C) {
+	s.conf.Clusters = append(s.conf.Clusters, clusterConfig{
+		Name:       "big",
+		URI:        "big.internal:27017",
+		PublicURI:  "big.example.com:27017",
+		ReplicaSet: "big",
+	})
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}, {Name: "large", Cluster: "big"}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "large"})
+	var used []string
+	newCluster = func(conf clusterConfig) Cluster {
+		used = append(used, conf.Name)
+		return s.cluster
+	}
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(used, check.DeepEquals, []string{"big"})
+	c.Assert(env["MONGODB_HOSTS"], check.Equals, "big.example.com:27017")
+	c.Assert(env["MONGODB_REPLICA_SET"], check.Equals, "big")
+}
+
+func (s *S) TestBindLegacyInstanceUsesTheDefaultCluster(c *check.C) {
+	s.conf.Clusters = append(s.conf.Clusters, clusterConfig{Name: "big", URI: "big.internal:27017"})
+	s.conf.Plans = []planConfig{{Name: "large", Cluster: "big", Options: map[string]string{"w": "majority"}}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Database: "myapp"})
+	var used []string
+	newCluster = func(conf clusterConfig) Cluster {
+		used = append(used, conf.Name)
+		return s.cluster
+	}
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(used, check.DeepEquals, []string{"default"})
+	conn, err := parseConnString(env["MONGODB_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.get("w"), check.Equals, "")
+}
+
+func (s *S) TestBindUsesTheInstanceCluster(c *check.C) {
+	s.conf.Clusters = append(s.conf.Clusters, clusterConfig{Name: "big", URI: "big.internal:27017"})
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small", Cluster: "big"})
+	var used []string
+	newCluster = func(conf clusterConfig) Cluster {
+		used = append(used, conf.Name)
+		return s.cluster
+	}
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(used, check.DeepEquals, []string{"big"})
+}
+
+func (s *S) TestBindWithPlanOptions(c *check.C) {
+	s.conf.Plans = []planConfig{{
+		Name:    "small",
+		Cluster: "default",
+		Options: map[string]string{"w": "majority", "readPreference": "secondaryPreferred", "maxPoolSize": "10"},
+	}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small"})
+	env, err := bind(context.Background(), "myapp", "myapp.tsuru.io", bindOptions{})
+	c.Assert(err, check.IsNil)
+	conn, err := parseConnString(env["MONGODB_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.Username, check.Equals, env["MONGODB_USER"])
+	c.Assert(conn.Password, check.Equals, env["MONGODB_PASSWORD"])
+	c.Assert(conn.Options, check.DeepEquals, []connOption{
+		{"authSource", "myapp"},
+		{"authMechanism", "SCRAM-SHA-1"},
+		{"maxPoolSize", "10"},
+		{"readPreference", "secondaryPreferred"},
+		{"w", "majority"},
+		{"appName", "myapp.tsuru.io"},
+	})
+}
+
+func (s *S) TestBindWithSRV(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.conf.Clusters[0].PublicURI = "mongodb+srv://cluster.example.com"
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(env["MONGODB_HOSTS"], check.Equals, "cluster.example.com")
+	expectedString := fmt.Sprintf("mongodb+srv://%s:%s@cluster.example.com/myapp?tls=false&authSource=myapp&authMechanism=SCRAM-SHA-1&appName=localhost", env["MONGODB_USER"], env["MONGODB_PASSWORD"])
+	c.Assert(env["MONGODB_CONNECTION_STRING"], check.Equals, expectedString)
 }
 
 func (s *S) TestBindShouldReturnLocalhostWhenThePublicHostEnvIsNil(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
 	body := strings.NewReader("app-host=localhost")
 	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
 	c.Assert(err, check.IsNil)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	os.Setenv("MONGODB_PUBLIC_URI", "")
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
-	defer func() {
-		database := session().DB("myapp")
-		database.RemoveUser("myapp")
-		database.DropDatabase()
-	}()
 	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
 	result, err := ioutil.ReadAll(recorder.Body)
 	c.Assert(err, check.IsNil)
@@ -84,63 +370,49 @@ func (s *S) TestBindShouldReturnLocalhostWhenThePublicHostEnvIsNil(c *check.C) {
 	c.Assert(data["MONGODB_DATABASE_NAME"], check.Equals, "myapp")
 	c.Assert(data["MONGODB_USER"], check.Not(check.HasLen), 0)
 	c.Assert(data["MONGODB_PASSWORD"], check.Not(check.HasLen), 0)
-	expectedString := fmt.Sprintf("mongodb://%s:%s@127.0.0.1:27017/myapp", data["MONGODB_USER"], data["MONGODB_PASSWORD"])
+	expectedString := fmt.Sprintf("mongodb://%s:%s@127.0.0.1:27017/myapp?authSource=myapp&authMechanism=SCRAM-SHA-1&appName=localhost", data["MONGODB_USER"], data["MONGODB_PASSWORD"])
 	c.Assert(data["MONGODB_CONNECTION_STRING"], check.Equals, expectedString)
-	coll := collection()
 	expected := dbBind{
 		AppHost:  "localhost",
 		Name:     "myapp",
 		User:     data["MONGODB_USER"],
 		Password: data["MONGODB_PASSWORD"],
 	}
-	var bind dbBind
-	q := bson.M{"name": "myapp"}
-	defer coll.Remove(q)
-	err = coll.Find(q).One(&bind)
+	bind, err := s.store.GetBind(context.Background(), "myapp", "localhost", readWriteBind)
 	c.Assert(err, check.IsNil)
 	c.Assert(bind, check.DeepEquals, expected)
 }
 
 func (s *S) TestBindWithReplicaSet(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
 	body := strings.NewReader("app-host=localhost")
 	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
 	c.Assert(err, check.IsNil)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	publicHost := "mongoapi.com:27017"
-	os.Setenv("MONGODB_PUBLIC_URI", publicHost)
-	os.Setenv("MONGODB_REPLICA_SET", "tsuru")
+	s.conf.Clusters[0].PublicURI = publicHost
+	s.conf.Clusters[0].ReplicaSet = "tsuru"
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
-	defer func() {
-		database := session().DB("myapp")
-		database.RemoveUser("myapp")
-		database.DropDatabase()
-		collection().Remove(bson.M{"name": "myapp"})
-	}()
 	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
 	var data map[string]string
 	err = json.NewDecoder(recorder.Body).Decode(&data)
 	c.Assert(err, check.IsNil)
 	c.Assert(data["MONGODB_REPLICA_SET"], check.Equals, "tsuru")
-	expectedString := fmt.Sprintf("mongodb://%s:%s@%s/myapp?replicaSet=tsuru", data["MONGODB_USER"], data["MONGODB_PASSWORD"], publicHost)
+	expectedString := fmt.Sprintf("mongodb://%s:%s@%s/myapp?replicaSet=tsuru&authSource=myapp&authMechanism=SCRAM-SHA-1&appName=localhost", data["MONGODB_USER"], data["MONGODB_PASSWORD"], publicHost)
 	c.Assert(data["MONGODB_CONNECTION_STRING"], check.Equals, expectedString)
 }
 
 func (s *S) TestBind(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
 	body := strings.NewReader("app-host=localhost")
 	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
 	c.Assert(err, check.IsNil)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	publicHost := "mongoapi.com:27017"
-	os.Setenv("MONGODB_PUBLIC_URI", publicHost)
+	s.conf.Clusters[0].PublicURI = publicHost
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
-	defer func() {
-		database := session().DB("myapp")
-		database.RemoveUser("myapp")
-		database.DropDatabase()
-		collection().Remove(bson.M{"name": "myapp"})
-	}()
 	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
 	result, err := ioutil.ReadAll(recorder.Body)
 	c.Assert(err, check.IsNil)
@@ -150,18 +422,195 @@ func (s *S) TestBind(c *check.C) {
 	c.Assert(data["MONGODB_DATABASE_NAME"], check.Equals, "myapp")
 	c.Assert(data["MONGODB_USER"], check.Not(check.HasLen), 0)
 	c.Assert(data["MONGODB_PASSWORD"], check.Not(check.HasLen), 0)
-	info := mgo.DialInfo{
-		Addrs:    []string{"localhost:27017"},
-		Database: data["MONGODB_DATABASE_NAME"],
-		Username: data["MONGODB_USER"],
-		Password: data["MONGODB_PASSWORD"],
+	password := s.cluster.password(data["MONGODB_DATABASE_NAME"], data["MONGODB_USER"])
+	c.Assert(password, check.Equals, data["MONGODB_PASSWORD"])
+	c.Assert(s.store.locks, check.HasLen, 0)
+}
+
+func (s *S) TestBindAddUserFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.fail("AddUser", errors.New("not authorized"))
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+	c.Assert(s.store.binds, check.HasLen, 0)
+	c.Assert(s.store.locks, check.HasLen, 0)
+}
+
+func (s *S) TestBindAlreadyBound(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("already-bound", "The app is already bound to the instance with this access"))
+	c.Assert(s.store.binds, check.HasLen, 1)
+	c.Assert(s.cluster.users["myapp"], check.HasLen, 1)
+}
+
+func (s *S) TestBindInstanceNotFound(c *check.C) {
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("instance-not-found", "Instance not found"))
+	c.Assert(s.cluster.users, check.HasLen, 0)
+}
+
+func (s *S) TestBindStoreFailureRemovesTheUser(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.store.fail("AddBind", errors.New("store is down"))
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.ErrorMatches, "store is down")
+	c.Assert(s.cluster.users["myapp"], check.HasLen, 0)
+}
+
+func (s *S) TestAddWaitsForTheLockOfTheCluster(c *check.C) {
+	acquired, err := s.store.Lock(context.Background(), addLockPrefix+"default")
+	c.Assert(err, check.IsNil)
+	c.Assert(acquired, check.Equals, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	body := strings.NewReader("name=myapp")
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request.WithContext(ctx))
+	c.Assert(recorder.Code, check.Not(check.Equals), http.StatusCreated)
+	c.Assert(s.store.instances, check.HasLen, 0)
+	s.store.Unlock(context.Background(), addLockPrefix+"default")
+	request, err = http.NewRequest("POST", "/resources", strings.NewReader("name=myapp"))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+}
+
+func (s *S) TestAddConcurrentInstancesGetDifferentDatabases(c *check.C) {
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.b", "a_b", "A_B"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			body := strings.NewReader("name=" + name)
+			request, _ := http.NewRequest("POST", "/resources", body)
+			request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			s.muxer.ServeHTTP(recorder, request)
+			c.Check(recorder.Code, check.Equals, http.StatusCreated)
+		}(name)
 	}
-	session, err := mgo.DialWithInfo(&info)
+	wg.Wait()
+	instances, err := s.store.ListInstances(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 3)
+	databases := make(map[string]bool)
+	for _, instance := range instances {
+		databases[strings.ToLower(instance.Database)] = true
+	}
+	c.Assert(databases, check.HasLen, 3)
+}
+
+func (s *S) TestBindLockFailure(c *check.C) {
+	s.store.fail("Lock", errors.New("store is down"))
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(s.cluster.users, check.HasLen, 0)
+}
+
+func (s *S) TestBindLockCanceled(c *check.C) {
+	s.store.locks["myapp"] = time.Now().Add(lockTTL)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request.WithContext(ctx))
+	c.Assert(recorder.Code, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("timeout", "Timed out waiting for MongoDB"))
+	c.Assert(s.cluster.users, check.HasLen, 0)
+	delete(s.store.locks, "myapp")
+	c.Assert(lock(context.Background(), "myapp"), check.IsNil)
+	unlock(context.Background(), "myapp")
+}
+
+// unlockRecorder records the config of the contexts given to Unlock.
+type unlockRecorder struct {
+	*fakeStore
+	configs []*config
+}
+
+func (s *unlockRecorder) Unlock(ctx context.Context, name string) error {
+	s.configs = append(s.configs, contextConfig(ctx))
+	return s.fakeStore.Unlock(ctx, name)
+}
+
+func (s *S) TestUnlockUsesTheConfigOfLock(c *check.C) {
+	store := &unlockRecorder{fakeStore: s.store}
+	currentStore = store
+	ctx, cancel := context.WithCancel(withConfig(context.Background(), s.conf))
+	c.Assert(lock(ctx, "myapp"), check.IsNil)
+	reloaded, err := loadConfig("")
+	c.Assert(err, check.IsNil)
+	setConfig(reloaded)
+	cancel()
+	unlock(ctx, "myapp")
+	c.Assert(store.configs, check.HasLen, 1)
+	c.Assert(store.configs[0] == s.conf, check.Equals, true)
+	c.Assert(s.store.locks, check.HasLen, 0)
+}
+
+func (s *S) TestBindWithTLS(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	dir := c.MkDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caFile, []byte("the CA"), 0600)
+	c.Assert(err, check.IsNil)
+	s.conf.Clusters[0].ReplicaSet = "tsuru"
+	s.conf.Clusters[0].TLS = clusterTLSConfig{Enabled: true, CAFile: caFile, Insecure: true}
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
 	c.Assert(err, check.IsNil)
-	defer session.Close()
-	err = session.DB(info.Database).C("mycollection").Insert(bson.M{"some": "stuff"})
+	expectedString := fmt.Sprintf("mongodb://%s:%s@127.0.0.1:27017/myapp?replicaSet=tsuru&tls=true&tlsInsecure=true&authSource=myapp&authMechanism=SCRAM-SHA-1&appName=localhost", env["MONGODB_USER"], env["MONGODB_PASSWORD"])
+	c.Assert(env["MONGODB_CONNECTION_STRING"], check.Equals, expectedString)
+	c.Assert(env["MONGODB_TLS_CA"], check.Equals, "the CA")
+}
+
+func (s *S) TestBindWithSCRAMSHA256(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.conf.Clusters[0].AuthMechanism = "SCRAM-SHA-256"
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
 	c.Assert(err, check.IsNil)
-	err = session.DB(info.Database).C("mycollection").Remove(bson.M{"some": "stuff"})
+	expectedString := fmt.Sprintf("mongodb://%s:%s@127.0.0.1:27017/myapp?authSource=myapp&authMechanism=SCRAM-SHA-256&appName=localhost", env["MONGODB_USER"], env["MONGODB_PASSWORD"])
+	c.Assert(env["MONGODB_CONNECTION_STRING"], check.Equals, expectedString)
+}
+
+func (s *S) TestBindWithTLSMissingCA(c *check.C) {
+	s.conf.Clusters[0].TLS = clusterTLSConfig{Enabled: true, CAFile: "/does/not/exist.pem"}
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cluster.users, check.HasLen, 0)
 }
 
 func (s *S) TestBindNoAppHost(c *check.C) {
@@ -172,17 +621,14 @@ func (s *S) TestBindNoAppHost(c *check.C) {
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
-	c.Assert(recorder.Body.String(), check.Equals, "Missing app-host")
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "Missing app-host"))
 }
 
 func (s *S) TestUnbind(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
 	name := "myapp"
-	env, err := bind(name, "localhost")
+	env, err := bind(context.Background(), name, "localhost", bindOptions{})
 	c.Assert(err, check.IsNil)
-	defer func() {
-		database := session().DB(name)
-		database.DropDatabase()
-	}()
 	body := strings.NewReader("app-host=localhost")
 	request, err := http.NewRequest("DELETE", "/resources/myapp/bind-app", body)
 	c.Assert(err, check.IsNil)
@@ -190,16 +636,177 @@ func (s *S) TestUnbind(c *check.C) {
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusOK)
-	info := mgo.DialInfo{
-		Addrs:    []string{"localhost:27017"},
-		Database: env["MONGODB_DATABASE"],
-		Username: env["MONGODB_USER"],
-		Password: env["MONGODB_PASSWORD"],
-		Timeout:  1e9,
-		FailFast: true,
+	c.Assert(s.cluster.password(name, env["MONGODB_USER"]), check.Equals, "")
+	c.Assert(s.store.binds, check.HasLen, 0)
+}
+
+func (s *S) TestUnbindNotFound(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("DELETE", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bind-not-found", "Bind not found"))
+}
+
+func (s *S) TestBindReadOnly(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	body := strings.NewReader("app-host=bi.tsuru.io&access=read")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var data map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&data)
+	c.Assert(err, check.IsNil)
+	c.Assert(data["MONGODB_USER"], check.Equals, "")
+	user := data["MONGODB_READ_USER"]
+	c.Assert(s.cluster.password("myapp", user), check.Equals, data["MONGODB_READ_PASSWORD"])
+	c.Assert(s.cluster.roles[user], check.Equals, "read")
+	c.Assert(data["MONGODB_READ_DATABASE_NAME"], check.Equals, "myapp")
+	conn, err := parseConnString(data["MONGODB_READ_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.get("readPreference"), check.Equals, "secondaryPreferred")
+	c.Assert(s.store.binds, check.DeepEquals, []dbBind{
+		{Name: "myapp", AppHost: "bi.tsuru.io", User: user, Password: data["MONGODB_READ_PASSWORD"], Kind: readBind},
+	})
+}
+
+func (s *S) TestBindReadOnlyWithPlanReadOptions(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small"})
+	s.conf.Plans = []planConfig{{
+		Name:        "small",
+		Cluster:     "default",
+		Options:     map[string]string{"w": "majority"},
+		ReadOptions: map[string]string{"readPreference": "secondary", "readPreferenceTags": "nodeType:ANALYTICS"},
+	}}
+	env, err := bind(context.Background(), "myapp", "bi.tsuru.io", bindOptions{Kind: readBind})
+	c.Assert(err, check.IsNil)
+	conn, err := parseConnString(env["MONGODB_READ_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.get("w"), check.Equals, "majority")
+	c.Assert(conn.get("readPreference"), check.Equals, "secondary")
+	c.Assert(conn.get("readPreferenceTags"), check.Equals, "nodeType:ANALYTICS")
+}
+
+func (s *S) TestBindWithEnvPrefix(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	body := strings.NewReader("app-host=localhost&env-prefix=orders")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var data map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&data)
+	c.Assert(err, check.IsNil)
+	for key := range data {
+		c.Check(strings.HasPrefix(key, "ORDERS_MONGODB_"), check.Equals, true)
 	}
-	_, err = mgo.DialWithInfo(&info)
-	c.Assert(err, check.NotNil)
+	c.Assert(data["ORDERS_MONGODB_DATABASE_NAME"], check.Equals, "myapp")
+	c.Assert(s.store.binds, check.HasLen, 1)
+	c.Assert(s.store.binds[0].EnvPrefix, check.Equals, "ORDERS")
+}
+
+func (s *S) TestBindReadOnlyWithEnvPrefix(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{Kind: readBind, EnvPrefix: "ORDERS"})
+	c.Assert(err, check.IsNil)
+	c.Assert(env["ORDERS_MONGODB_READ_DATABASE_NAME"], check.Equals, "myapp")
+	c.Assert(env["ORDERS_MONGODB_READ_USER"], check.Not(check.Equals), "")
+}
+
+func (s *S) TestBindInvalidEnvPrefix(c *check.C) {
+	body := strings.NewReader("app-host=localhost&env-prefix=1orders")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "Invalid env-prefix, must be auto or a valid variable name"))
+	c.Assert(s.cluster.users, check.HasLen, 0)
+}
+
+func (s *S) TestEnvPrefix(c *check.C) {
+	var tests = []struct {
+		param, name string
+		prefix      string
+		ok          bool
+	}{
+		{"", "myapp", "", true},
+		{"orders", "myapp", "ORDERS", true},
+		{"Orders_DB2", "myapp", "ORDERS_DB2", true},
+		{"auto", "orders-db", "ORDERS_DB", true},
+		{"auto", "2fa.codes", "_2FA_CODES", true},
+		{"orders-db", "myapp", "", false},
+		{"1orders", "myapp", "", false},
+	}
+	for _, t := range tests {
+		prefix, ok := envPrefix(t.param, t.name)
+		c.Check(prefix, check.Equals, t.prefix)
+		c.Check(ok, check.Equals, t.ok)
+	}
+}
+
+func (s *S) TestBindInvalidAccess(c *check.C) {
+	body := strings.NewReader("app-host=localhost&access=admin")
+	request, err := http.NewRequest("POST", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "Invalid access, must be read or read-write"))
+	c.Assert(s.cluster.users, check.HasLen, 0)
+}
+
+func (s *S) TestUnbindOnlyRemovesTheBindOfTheGivenAccess(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	rw, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	ro, err := bind(context.Background(), "myapp", "localhost", bindOptions{Kind: readBind})
+	c.Assert(err, check.IsNil)
+	unbindRequest := func(params string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("DELETE", "/resources/myapp/bind-app", strings.NewReader(params))
+		c.Assert(err, check.IsNil)
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.muxer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := unbindRequest("app-host=localhost")
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("ambiguous-bind", "The app has more than one bind, access is required"))
+	recorder = unbindRequest("app-host=localhost&access=read")
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(s.cluster.password("myapp", ro["MONGODB_READ_USER"]), check.Equals, "")
+	c.Assert(s.cluster.password("myapp", rw["MONGODB_USER"]), check.Equals, rw["MONGODB_PASSWORD"])
+	recorder = unbindRequest("app-host=localhost")
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(s.cluster.password("myapp", rw["MONGODB_USER"]), check.Equals, "")
+	c.Assert(s.store.binds, check.HasLen, 0)
+}
+
+func (s *S) TestUnbindRemoveUserFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	s.cluster.fail("RemoveUser", errors.New("not authorized"))
+	body := strings.NewReader("app-host=localhost")
+	request, err := http.NewRequest("DELETE", "/resources/myapp/bind-app", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
 }
 
 func (s *S) TestBindUnit(c *check.C) {
@@ -220,27 +827,233 @@ func (s *S) TestUnbindUnit(c *check.C) {
 
 func (s *S) TestRemoveShouldRemoveBinds(c *check.C) {
 	name := "myapp"
-	collection().Insert(dbBind{Name: name})
-	database := session().DB(name)
-	database.AddUser(name, "", false)
+	s.store.AddInstance(context.Background(), dbInstance{Name: name})
+	s.store.AddBind(context.Background(), dbBind{Name: name})
+	s.cluster.AddUser(context.Background(), name, name, "", "readWrite")
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	binds, err := s.store.ListBinds(context.Background(), name)
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 0)
+	_, err = s.store.GetInstance(context.Background(), name)
+	c.Assert(err, check.Equals, errNotFound)
+	c.Assert(s.cluster.dropped, check.DeepEquals, []string{name})
+}
+
+func (s *S) TestRemoveDropDatabaseFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.fail("DropDatabase", errors.New("not authorized"))
 	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
 	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+}
+
+func (s *S) TestRemoveDropDatabaseFailureKeepsTheRecords(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Database: "myapp_1a2b"})
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	s.cluster.fail("DropDatabase", errors.New("not authorized"))
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	instance, err := s.store.GetInstance(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Database, check.Equals, "myapp_1a2b")
+	binds, err := s.store.ListBinds(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 1)
+	s.cluster.fail("DropDatabase", nil)
+	recorder = httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusOK)
-	count, err := collection().Find(bson.M{"name": name}).Count()
+	c.Assert(s.cluster.dropped, check.DeepEquals, []string{"myapp_1a2b"})
+	_, err = s.store.GetInstance(context.Background(), "myapp")
+	c.Assert(err, check.Equals, errNotFound)
+}
+
+func (s *S) TestRemoveWaitsForTheLock(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	acquired, err := s.store.Lock(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(acquired, check.Equals, true)
+	defer s.store.Unlock(context.Background(), "myapp")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request.WithContext(ctx))
+	c.Assert(recorder.Code, check.Not(check.Equals), http.StatusOK)
+	c.Assert(s.cluster.dropped, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveInstanceOfRemovedCluster(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Cluster: "removed", Database: "myapp"})
+	s.cluster.databases = []string{"myapp"}
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("cluster-not-found", "The cluster of the instance is not in the config"))
+	c.Assert(s.cluster.dropped, check.HasLen, 0)
+	_, err = s.store.GetInstance(context.Background(), "myapp")
 	c.Assert(err, check.IsNil)
-	c.Assert(count, check.Equals, 0)
+}
+
+func (s *S) TestRemoveDropDatabaseTimeout(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.fail("DropDatabase", errTimeout)
+	request, err := http.NewRequest("DELETE", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusGatewayTimeout)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("timeout", "Timed out waiting for MongoDB"))
 }
 
 func (s *S) TestStatus(c *check.C) {
-	name := "myapp"
-	database := session().DB(name)
-	database.AddUser(name, "", false)
-	defer func() {
-		database.RemoveUser("myapp")
-		database.DropDatabase()
-	}()
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	request, err := http.NewRequest("GET", "/resources/myapp/status", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	c.Assert(s.cluster.pings, check.Equals, 1)
+}
+
+func (s *S) TestStatusPingFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.fail("Ping", errClusterUnavailable)
+	request, err := http.NewRequest("GET", "/resources/myapp/status", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("cluster-unavailable", "MongoDB is unavailable"))
+}
+
+func (s *S) TestPinConfig(c *check.C) {
+	reloaded := &config{Clusters: []clusterConfig{{Name: "reloaded"}}}
+	var got *config
+	h := pinConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setConfig(reloaded)
+		got = contextConfig(r.Context())
+	}))
+	request, err := http.NewRequest("GET", "/resources", nil)
+	c.Assert(err, check.IsNil)
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(got, check.Equals, s.conf)
+	c.Assert(contextConfig(context.Background()), check.Equals, reloaded)
+}
+
+func (s *S) TestHealthz(c *check.C) {
+	s.conf.Auth = authConfig{Username: "tsuru", Password: "secret"}
+	s.store.fail("ListMigrations", errors.New("store is down"))
+	request, err := http.NewRequest("GET", "/healthz", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "WORKING")
+}
+
+// readyz returns the status code and the body of the readiness probe.
+func (s *S) readyz(c *check.C) (int, readiness) {
+	request, err := http.NewRequest("GET", "/readyz", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var status readiness
+	err = json.NewDecoder(recorder.Body).Decode(&status)
+	c.Assert(err, check.IsNil)
+	return recorder.Code, status
+}
+
+func (s *S) TestReadyz(c *check.C) {
+	s.conf.Auth = authConfig{Username: "tsuru", Password: "secret"}
+	s.conf.Clusters = append(s.conf.Clusters, clusterConfig{Name: "big", URI: "big.internal:27017"})
+	err := migrate(context.Background(), ioutil.Discard)
+	c.Assert(err, check.IsNil)
+	code, status := s.readyz(c)
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(status, check.DeepEquals, readiness{
+		Ready: true,
+		Checks: map[string]string{
+			"store":           "ok",
+			"migrations":      "ok",
+			"cluster default": "ok",
+			"cluster big":     "ok",
+		},
+	})
+}
+
+func (s *S) TestReadyzPendingMigrations(c *check.C) {
+	code, status := s.readyz(c)
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(status.Ready, check.Equals, false)
+	c.Assert(status.Checks["store"], check.Equals, "ok")
+	c.Assert(status.Checks["migrations"], check.Equals, fmt.Sprintf("%d pending", len(migrations)))
+}
+
+func (s *S) TestReadyzStoreFailure(c *check.C) {
+	s.store.fail("ListMigrations", errors.New("store is down"))
+	code, status := s.readyz(c)
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(status.Checks, check.DeepEquals, map[string]string{
+		"store":           "Internal error",
+		"cluster default": "ok",
+	})
+}
+
+func (s *S) TestReadyzClusterFailure(c *check.C) {
+	err := migrate(context.Background(), ioutil.Discard)
+	c.Assert(err, check.IsNil)
+	s.cluster.fail("Ping", errClusterUnavailable)
+	code, status := s.readyz(c)
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(status.Ready, check.Equals, false)
+	c.Assert(status.Checks["cluster default"], check.Equals, "MongoDB is unavailable")
+}
+
+func (s *S) TestReadyzClusterBreakerOpen(c *check.C) {
+	err := migrate(context.Background(), ioutil.Discard)
+	c.Assert(err, check.IsNil)
+	cluster := s.conf.Clusters[0]
+	defer closeClients([]string{cluster.connKey()})
+	conn := getConn(cluster)
+	for i := 0; i < breakerThreshold; i++ {
+		conn.done(errClusterUnavailable, errors.New("connection refused"))
+	}
+	c.Assert(clusterReady(cluster), check.NotNil)
+	s.cluster.fail("Ping", errClusterUnavailable)
+	code, status := s.readyz(c)
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(status.Checks["cluster default"], check.Equals, "MongoDB is unavailable")
+}
+
+func (s *S) TestStatusInstanceNotFound(c *check.C) {
+	request, err := http.NewRequest("GET", "/resources/myapp/status", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("instance-not-found", "Instance not found"))
+	c.Assert(s.cluster.pings, check.Equals, 0)
+}
+
+func (s *S) TestStatusLegacyInstance(c *check.C) {
+	s.store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1"})
 	request, err := http.NewRequest("GET", "/resources/myapp/status", nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -248,12 +1061,29 @@ func (s *S) TestStatus(c *check.C) {
 	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
 }
 
+func (s *S) TestStatusDatabaseWithoutInstance(c *check.C) {
+	s.cluster.databases = []string{"myapp"}
+	request, err := http.NewRequest("GET", "/resources/myapp/status", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("instance-not-found", "Instance not found"))
+}
+
+// jsonError returns the body of the error response with the given kind and
+// message.
+func jsonError(kind, message string) string {
+	body, _ := json.Marshal(errorBody{Error: kind, Message: message})
+	return string(body) + "\n"
+}
+
 func errorHandler(w http.ResponseWriter, r *http.Request) error {
 	return errors.New("some error")
 }
 
 func httpErrorHandler(w http.ResponseWriter, r *http.Request) error {
-	return &httpError{code: 400, body: "please provide a name"}
+	return badRequest("please provide a name")
 }
 
 func simpleHandler(w http.ResponseWriter, r *http.Request) error {
@@ -267,7 +1097,7 @@ func (s *S) TestHandlerReturns500WhenInternalHandlerReturnsAnError(c *check.C) {
 	c.Assert(err, check.IsNil)
 	Handler(errorHandler).ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, 500)
-	c.Assert(recorder.Body.String(), check.Equals, "some error\n")
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
 }
 
 func (s *S) TestHandlerWithHTTPError(c *check.C) {
@@ -276,7 +1106,7 @@ func (s *S) TestHandlerWithHTTPError(c *check.C) {
 	c.Assert(err, check.IsNil)
 	Handler(httpErrorHandler).ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, 400)
-	c.Assert(recorder.Body.String(), check.Equals, "please provide a name\n")
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("bad-request", "please provide a name"))
 }
 
 func (s *S) TestHandlerShouldPassAnHandlerWithoutError(c *check.C) {
@@ -9,37 +9,81 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/bmizerany/pat"
 )
 
 const version = "0.3"
 
+// configCheckInterval is how often the config file is checked for changes.
+const configCheckInterval = 5 * time.Second
+
 var printVersion bool
 var listen string
+var configPath string
+var tlsCert, tlsKey, tlsClientCA string
 
 func init() {
 	flag.BoolVar(&printVersion, "v", false, "Print version and exit")
-	flag.StringVar(&listen, "bind", "0.0.0.0:3030", "Bind the service on this port")
-	flag.Parse()
+	flag.StringVar(&listen, "bind", "", "Bind the service on this port (overrides listen in the config file)")
+	flag.StringVar(&configPath, "config", "", "Path to the YAML config file")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve HTTPS with this certificate (overrides tls.cert-file in the config file)")
+	flag.StringVar(&tlsKey, "tls-key", "", "Key of the certificate given in -tls-cert (overrides tls.key-file in the config file)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "Require client certificates signed by this CA (overrides tls.client-ca-file in the config file)")
+}
+
+// applyFlags overrides the values in the config with the ones given in the
+// command line.
+func applyFlags(c *config) error {
+	if listen != "" {
+		c.Listen = listen
+	}
+	if tlsCert != "" || tlsKey != "" {
+		c.TLS.CertFile, c.TLS.KeyFile = tlsCert, tlsKey
+	}
+	if tlsClientCA != "" {
+		c.TLS.ClientCAFile = tlsClientCA
+	}
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+	return nil
 }
 
 func buildMux() http.Handler {
 	m := pat.New()
-	m.Post("/resources", http.HandlerFunc(Add))
+	m.Get("/resources/plans", Handler(Plans))
+	m.Get("/resources", Handler(List))
+	m.Post("/resources", Handler(Add))
 	m.Post("/resources/:name/bind-app", Handler(BindApp))
 	m.Del("/resources/:name/bind-app", Handler(UnbindApp))
 	m.Post("/resources/:name/bind", Handler(BindUnit))
 	m.Del("/resources/:name/bind", Handler(UnbindUnit))
+	m.Get("/resources/:name", Handler(Info))
 	m.Del("/resources/:name", Handler(Remove))
 	m.Get("/resources/:name/status", Handler(Status))
-	return m
+	m.Get("/clusters/:cluster/crl", Handler(CRL))
+	return pinConfig(withProbes(basicAuth(m)))
 }
 
 func main() {
+	flag.Usage = usage
+	flag.Parse()
 	if printVersion {
 		fmt.Printf("mongoapi version %s", version)
 		return
 	}
-	log.Fatal(http.ListenAndServe(listen, buildMux()))
+	c, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = applyFlags(c); err != nil {
+		log.Fatal(err)
+	}
+	setConfig(c)
+	if err = runCommand(flag.Args(), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,164 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// migration is a change to the metadata in the store. Migrations are applied
+// once, in order of version, and recorded in the store. New migrations must
+// be appended with the next version.
+type migration struct {
+	version int
+	name    string
+	run     func(ctx context.Context, store Store, w io.Writer) error
+}
+
+var migrations = []migration{
+	{version: 1, name: "add the records of instances created before the store", run: addLegacyInstances},
+	{version: 2, name: "create the indexes of the metadata", run: createIndexes},
+	{version: 3, name: "make the databases of instances unique in each cluster", run: uniqueDatabases},
+}
+
+// migrationsLock is the name of the lock held while migrating, which can't
+// clash with instance names.
+const migrationsLock = "$migrations"
+
+// migrate applies the pending migrations to the store, writing their
+// progress to w.
+func migrate(ctx context.Context, w io.Writer) error {
+	if err := lock(ctx, migrationsLock); err != nil {
+		return err
+	}
+	defer unlock(ctx, migrationsLock)
+	store := getStore()
+	pending, err := pendingMigrations(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		fmt.Fprintf(w, "applying migration %d: %s\n", m.version, m.name)
+		if err := m.run(ctx, store, w); err != nil {
+			return fmt.Errorf("migration %d failed: %s", m.version, err)
+		}
+		err := store.AddMigration(ctx, dbMigration{Version: m.version, Name: m.name, Time: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations that weren't applied to the
+// store yet.
+func pendingMigrations(ctx context.Context, store Store) ([]migration, error) {
+	applied, err := store.ListMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if !done[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// addLegacyInstances creates the records of the instances created before the
+// store was introduced, found in their binds, so they're listed and keep
+// using their name as the database name.
+func addLegacyInstances(ctx context.Context, store Store, w io.Writer) error {
+	binds, err := store.ListAllBinds(ctx)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, bind := range binds {
+		if seen[bind.Name] {
+			continue
+		}
+		seen[bind.Name] = true
+		_, err := store.GetInstance(ctx, bind.Name)
+		if err == nil {
+			continue
+		}
+		if err != errNotFound {
+			return err
+		}
+		instance := dbInstance{
+			Name:      bind.Name,
+			Cluster:   contextConfig(ctx).Clusters[0].Name,
+			Database:  bind.Name,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := store.AddInstance(ctx, instance); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: added the record of the instance\n", bind.Name)
+	}
+	return nil
+}
+
+// indexer is implemented by the stores that need indexes.
+type indexer interface {
+	ensureIndexes(ctx context.Context, w io.Writer) error
+}
+
+// createIndexes creates the indexes of the store. Duplicated binds left by
+// the stores that didn't enforce their uniqueness are removed, keeping the
+// newest one, so their users are removed by reconcile.
+func createIndexes(ctx context.Context, store Store, w io.Writer) error {
+	if s, ok := store.(indexer); ok {
+		return s.ensureIndexes(ctx, w)
+	}
+	return nil
+}
+
+// databaseIndexer is implemented by the stores that need an index to keep
+// the databases of instances unique.
+type databaseIndexer interface {
+	ensureDatabaseIndex(ctx context.Context) error
+}
+
+// uniqueDatabases makes the databases of instances unique in each cluster,
+// which concurrent requests to add instances could break. Instances sharing
+// a database are listed in the error, as removing one of them would drop the
+// data of the other: they must be sorted out before migrating again.
+func uniqueDatabases(ctx context.Context, store Store, w io.Writer) error {
+	instances, err := store.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+	owners := make(map[string]dbInstance)
+	var shared []string
+	for _, instance := range instances {
+		if instance.Database == "" {
+			continue
+		}
+		k := instance.Cluster + "/" + strings.ToLower(instance.Database)
+		if owner, ok := owners[k]; ok {
+			shared = append(shared, fmt.Sprintf("%s and %s share the database %s in the cluster %q", owner.Name, instance.Name, instance.Database, instance.Cluster))
+			continue
+		}
+		owners[k] = instance
+	}
+	if len(shared) > 0 {
+		return fmt.Errorf("instances sharing databases: %s", strings.Join(shared, "; "))
+	}
+	if s, ok := store.(databaseIndexer); ok {
+		return s.ensureDatabaseIndex(ctx)
+	}
+	return nil
+}
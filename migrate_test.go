@@ -0,0 +1,60 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestMigrationVersions(c *check.C) {
+	for i, m := range migrations {
+		c.Check(m.version, check.Equals, i+1)
+	}
+}
+
+func (s *S) TestMigrateFailure(c *check.C) {
+	s.store.AddBind(context.Background(), dbBind{Name: "legacy", AppHost: "app1"})
+	s.store.fail("AddInstance", errors.New("store is down"))
+	err := migrate(context.Background(), &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, "migration 1 failed: store is down")
+	c.Assert(s.store.migrations, check.HasLen, 0)
+	c.Assert(s.store.locks, check.HasLen, 0)
+	s.store.fail("AddInstance", nil)
+	c.Assert(migrate(context.Background(), &bytes.Buffer{}), check.IsNil)
+	c.Assert(s.store.migrations, check.HasLen, len(migrations))
+}
+
+func (s *S) TestMigrateSkipsApplied(c *check.C) {
+	s.store.AddMigration(context.Background(), dbMigration{Version: 1, Name: migrations[0].name})
+	s.store.AddBind(context.Background(), dbBind{Name: "legacy", AppHost: "app1"})
+	var out bytes.Buffer
+	c.Assert(migrate(context.Background(), &out), check.IsNil)
+	c.Assert(out.String(), check.Equals, ""+
+		"applying migration 2: create the indexes of the metadata\n"+
+		"applying migration 3: make the databases of instances unique in each cluster\n")
+	_, err := s.store.GetInstance(context.Background(), "legacy")
+	c.Assert(err, check.Equals, errNotFound)
+}
+
+func (s *S) TestMigrateSharedDatabases(c *check.C) {
+	s.store.instances = []dbInstance{
+		{Name: "a.b", Cluster: "default", Database: "a_b"},
+		{Name: "a_b", Cluster: "default", Database: "a_b"},
+		{Name: "foo", Cluster: "default", Database: "foo"},
+		{Name: "Foo", Cluster: "big", Database: "Foo"},
+		{Name: "legacy"},
+		{Name: "legacy2"},
+	}
+	err := migrate(context.Background(), &bytes.Buffer{})
+	c.Assert(err, check.ErrorMatches, `migration 3 failed: instances sharing databases: a.b and a_b share the database a_b in the cluster "default"`)
+	c.Assert(s.store.migrations, check.HasLen, 2)
+	s.store.instances = s.store.instances[1:]
+	c.Assert(migrate(context.Background(), &bytes.Buffer{}), check.IsNil)
+	c.Assert(s.store.migrations, check.HasLen, len(migrations))
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// reconcile brings the users in the clusters in line with the binds in the
+// store: users of binds missing in the cluster are added again, and users
+// created by the service that no longer have a bind are removed. The changes
+// are written to w, and only made when dryRun isn't set.
+func reconcile(ctx context.Context, dryRun bool, w io.Writer) error {
+	store := getStore()
+	binds, err := store.ListAllBinds(ctx)
+	if err != nil {
+		return err
+	}
+	instances, err := store.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string][]dbBind)
+	for _, instance := range instances {
+		byName[instance.Name] = nil
+	}
+	for _, bind := range binds {
+		byName[bind.Name] = append(byName[bind.Name], bind)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reservedName(ctx, name) {
+			fmt.Fprintf(w, "%s: skipping reserved name\n", name)
+			continue
+		}
+		if err := reconcileInstance(ctx, name, byName[name], dryRun, w); err != nil {
+			return fmt.Errorf("failed to reconcile %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func reconcileInstance(ctx context.Context, name string, binds []dbBind, dryRun bool, w io.Writer) error {
+	if err := lock(ctx, name); err != nil {
+		return err
+	}
+	defer unlock(ctx, name)
+	instance, _, cluster, err := getInstance(ctx, name)
+	if err != nil {
+		return err
+	}
+	db := instance.database()
+	c := newCluster(cluster)
+	users, err := c.Users(ctx, db)
+	if err != nil {
+		return err
+	}
+	existing := stringSet(users)
+	var external map[string]bool
+	expected := make(map[string]bool)
+	for _, bind := range binds {
+		expected[bind.User] = true
+		if bind.CertSerial != "" {
+			if external == nil {
+				users, err := c.Users(ctx, externalDB)
+				if err != nil {
+					return err
+				}
+				external = stringSet(users)
+			}
+			if external[bind.User] {
+				continue
+			}
+			fmt.Fprintf(w, "%s: adding missing user %q of %s\n", name, bind.User, bind.AppHost)
+			if !dryRun {
+				if err := c.AddX509User(ctx, db, bind.User, bindRole(bind.Kind)); err != nil {
+					return err
+				}
+				audit(ctx, name, "reconcile", bind.AppHost)
+			}
+			continue
+		}
+		if existing[bind.User] {
+			continue
+		}
+		fmt.Fprintf(w, "%s: adding missing user %q of %s\n", name, bind.User, bind.AppHost)
+		if !dryRun {
+			if err := c.AddUser(ctx, db, bind.User, bind.Password, bindRole(bind.Kind)); err != nil {
+				return err
+			}
+			audit(ctx, name, "reconcile", bind.AppHost)
+		}
+	}
+	for _, user := range users {
+		if expected[user] || !serviceUser(name, user) {
+			continue
+		}
+		fmt.Fprintf(w, "%s: removing user %q without a bind\n", name, user)
+		if !dryRun {
+			if err := c.RemoveUser(ctx, db, user); err != nil {
+				return err
+			}
+			audit(ctx, name, "reconcile", "")
+		}
+	}
+	return nil
+}
+
+// serviceUser tells whether the given user was created by the service for a
+// bind of the instance, so users created by other means are left alone.
+func serviceUser(name, user string) bool {
+	suffix := strings.TrimPrefix(user, name)
+	if len(suffix) != 8 || len(user) != len(name)+8 {
+		return false
+	}
+	for _, r := range suffix {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"time"
+)
+
+// clientRetireDelay is the amount of time a client that's no longer used by
+// the config is kept connected, so in-flight requests can finish with it.
+var clientRetireDelay = time.Minute
+
+// reloadConfig loads the config file again and replaces the config in use.
+// Requests that are running keep the config they started with, and clients
+// connect again for the clusters that changed. When the new config is
+// invalid, the current one is kept.
+func reloadConfig(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err = applyFlags(c); err != nil {
+		return err
+	}
+	old := currentConfig()
+	if c.Listen != old.Listen {
+		log.Printf("listen can't be changed without a restart, keeping %s", old.Listen)
+		c.Listen = old.Listen
+	}
+	if (c.TLS.CertFile == "") != (old.TLS.CertFile == "") {
+		log.Print("TLS can't be enabled or disabled without a restart, keeping the current settings")
+		c.TLS = old.TLS
+	}
+	if c.DNS.Listen != old.DNS.Listen {
+		log.Printf("dns.listen can't be changed without a restart, keeping %q", old.DNS.Listen)
+		c.DNS.Listen = old.DNS.Listen
+	}
+	if c.Metadata != old.Metadata {
+		log.Print("metadata can't be changed without a restart, keeping the current settings")
+		c.Metadata = old.Metadata
+	}
+	setConfig(c)
+	changed, removed := diffClusters(old.Clusters, c.Clusters)
+	for _, cluster := range changed {
+		warmUp(cluster)
+	}
+	var keys []string
+	for _, cluster := range removed {
+		if !usesConn(c.Clusters, cluster.connKey()) && !storeUsesConn(cluster.connKey()) {
+			keys = append(keys, cluster.connKey())
+		}
+	}
+	if len(keys) > 0 {
+		time.AfterFunc(clientRetireDelay, func() { closeClients(keys) })
+	}
+	log.Printf("config reloaded from %s", path)
+	return nil
+}
+
+// diffClusters returns the clusters in new that were added or changed since
+// old, and the ones in old that were removed or had their connection settings
+// changed.
+func diffClusters(old, new []clusterConfig) (changed, removed []clusterConfig) {
+	byName := make(map[string]clusterConfig, len(old))
+	for _, cluster := range old {
+		byName[cluster.Name] = cluster
+	}
+	for _, cluster := range new {
+		previous, ok := byName[cluster.Name]
+		if !ok || !reflect.DeepEqual(previous, cluster) {
+			changed = append(changed, cluster)
+		}
+		if ok && previous.connKey() != cluster.connKey() {
+			removed = append(removed, previous)
+		}
+		delete(byName, cluster.Name)
+	}
+	for _, cluster := range old {
+		if _, ok := byName[cluster.Name]; ok {
+			removed = append(removed, cluster)
+		}
+	}
+	return changed, removed
+}
+
+func usesConn(clusters []clusterConfig, key string) bool {
+	for _, cluster := range clusters {
+		if cluster.connKey() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// storeUsesConn reports whether the mongodb store, which keeps the cluster it
+// was created with, connects with the given key.
+func storeUsesConn(key string) bool {
+	s, ok := getStore().(*mongoStore)
+	return ok && s.cluster.connKey() == key
+}
+
+// warmUp connects to the given cluster, so connection problems show up in the
+// logs right after the reload.
+func warmUp(cluster clusterConfig) {
+	if err := newCluster(cluster).Ping(context.Background()); err != nil {
+		log.Printf("failed to connect to cluster %q: %s", cluster.Name, err)
+	}
+}
+
+// watchConfig reloads the config file whenever a signal arrives in signals or
+// the file is modified, checking it every interval, until stop is closed.
+func watchConfig(path string, interval time.Duration, signals <-chan os.Signal, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastMod := modTime(path)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signals:
+		case <-ticker.C:
+			mod := modTime(path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+		}
+		lastMod = modTime(path)
+		if err := reloadConfig(path); err != nil {
+			log.Printf("failed to reload config, keeping the current one: %s", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
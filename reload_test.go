@@ -0,0 +1,167 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+const reloadConfigFile = `
+listen: 127.0.0.1:8080
+clusters:
+  - name: main
+    uri: mongo1.internal:27017
+    public-uri: mongo1.example.com:27017
+`
+
+// waitFor checks cond until it's true or a second has passed.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (s *S) loadConfigFile(c *check.C, content string) string {
+	path := writeConfig(c, content)
+	conf, err := loadConfig(path)
+	c.Assert(err, check.IsNil)
+	setConfig(conf)
+	return path
+}
+
+func (s *S) TestReloadConfig(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	old := currentConfig()
+	err := ioutil.WriteFile(path, []byte(`
+listen: 127.0.0.1:8080
+clusters:
+  - name: main
+    uri: mongo1.internal:27017
+    public-uri: mongo.example.com:27017
+  - name: big
+    uri: big.internal:27017
+`), 0600)
+	c.Assert(err, check.IsNil)
+	err = reloadConfig(path)
+	c.Assert(err, check.IsNil)
+	conf := currentConfig()
+	c.Assert(conf.Clusters, check.HasLen, 2)
+	c.Assert(conf.Clusters[0].PublicURI, check.Equals, "mongo.example.com:27017")
+	c.Assert(old.Clusters, check.HasLen, 1)
+	c.Assert(old.Clusters[0].PublicURI, check.Equals, "mongo1.example.com:27017")
+}
+
+func (s *S) TestReloadConfigPingsChangedClusters(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	var pinged []string
+	newCluster = func(conf clusterConfig) Cluster {
+		pinged = append(pinged, conf.Name)
+		return s.cluster
+	}
+	err := ioutil.WriteFile(path, []byte(reloadConfigFile+`
+  - name: big
+    uri: big.internal:27017
+`), 0600)
+	c.Assert(err, check.IsNil)
+	err = reloadConfig(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(pinged, check.DeepEquals, []string{"big"})
+	c.Assert(s.cluster.pings, check.Equals, 1)
+}
+
+func (s *S) TestReloadConfigInvalid(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	old := currentConfig()
+	err := ioutil.WriteFile(path, []byte("plans:\n  - name: small\n    cluster: unknown\n"), 0600)
+	c.Assert(err, check.IsNil)
+	err = reloadConfig(path)
+	c.Assert(err, check.ErrorMatches, `invalid config: plans\[0\]: plan "small" uses unknown cluster "unknown"`)
+	c.Assert(currentConfig(), check.Equals, old)
+}
+
+func (s *S) TestReloadConfigKeepsListenAndMetadata(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	err := ioutil.WriteFile(path, []byte(`
+listen: 0.0.0.0:9090
+metadata:
+  store: bolt
+clusters:
+  - name: main
+    uri: mongo1.internal:27017
+`), 0600)
+	c.Assert(err, check.IsNil)
+	err = reloadConfig(path)
+	c.Assert(err, check.IsNil)
+	conf := currentConfig()
+	c.Assert(conf.Listen, check.Equals, "127.0.0.1:8080")
+	c.Assert(conf.Metadata.Store, check.Equals, "mongodb")
+	c.Assert(conf.Clusters[0].PublicURI, check.Equals, "mongo1.internal:27017")
+}
+
+func (s *S) TestStoreUsesConn(c *check.C) {
+	main := clusterConfig{Name: "main", URI: "mongo1.internal:27017"}
+	other := clusterConfig{Name: "main", URI: "mongo2.internal:27017"}
+	c.Assert(storeUsesConn(main.connKey()), check.Equals, false)
+	currentStore = &mongoStore{cluster: main}
+	c.Assert(storeUsesConn(main.connKey()), check.Equals, true)
+	c.Assert(storeUsesConn(other.connKey()), check.Equals, false)
+}
+
+func (s *S) TestDiffClusters(c *check.C) {
+	old := []clusterConfig{
+		{Name: "same", URI: "same:27017"},
+		{Name: "public", URI: "public:27017", PublicURI: "old.example.com"},
+		{Name: "moved", URI: "old:27017"},
+		{Name: "removed", URI: "removed:27017"},
+	}
+	new := []clusterConfig{
+		{Name: "same", URI: "same:27017"},
+		{Name: "public", URI: "public:27017", PublicURI: "new.example.com"},
+		{Name: "moved", URI: "new:27017"},
+		{Name: "added", URI: "added:27017"},
+	}
+	changed, removed := diffClusters(old, new)
+	c.Assert(changed, check.DeepEquals, []clusterConfig{new[1], new[2], new[3]})
+	c.Assert(removed, check.DeepEquals, []clusterConfig{old[2], old[3]})
+}
+
+func (s *S) TestWatchConfigSignal(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	signals := make(chan os.Signal)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(path, time.Hour, signals, stop)
+	err := ioutil.WriteFile(path, []byte(reloadConfigFile+"plans:\n  - name: small\n"), 0600)
+	c.Assert(err, check.IsNil)
+	signals <- syscall.SIGHUP
+	c.Assert(waitFor(func() bool {
+		return len(currentConfig().Plans) == 1
+	}), check.Equals, true)
+}
+
+func (s *S) TestWatchConfigFileChange(c *check.C) {
+	path := s.loadConfigFile(c, reloadConfigFile)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(path, 10*time.Millisecond, nil, stop)
+	time.Sleep(20 * time.Millisecond)
+	err := ioutil.WriteFile(path, []byte(reloadConfigFile+"plans:\n  - name: small\n"), 0600)
+	c.Assert(err, check.IsNil)
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, future, future)
+	c.Assert(err, check.IsNil)
+	c.Assert(waitFor(func() bool {
+		return len(currentConfig().Plans) == 1
+	}), check.Equals, true)
+}
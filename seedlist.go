@@ -0,0 +1,250 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// srvPrefix is prepended to the seedlist name in SRV queries made by the
+// drivers.
+const srvPrefix = "_mongodb._tcp."
+
+const (
+	// maxUDPSize is the maximum size of responses over UDP. Larger ones are
+	// truncated, and resolvers retry the query over TCP.
+	maxUDPSize = 512
+	// maxTCPSize is the maximum size of messages over TCP, which are
+	// prefixed by their length in two bytes.
+	maxTCPSize = 65535
+	// tcpIdleTimeout is how long TCP connections are kept open waiting for
+	// the next query.
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// seedlistServer answers the DNS queries for the seedlist names of the
+// clusters, so apps bound with mongodb+srv:// connection strings find the
+// current members of the cluster without binding again. Queries are answered
+// over UDP and TCP in the same address, each one in its own goroutine, so a
+// slow cluster doesn't delay the answers for the others.
+type seedlistServer struct {
+	conn     net.PacketConn
+	listener net.Listener
+	queries  sync.WaitGroup
+}
+
+func listenSeedlist(addr string) (*seedlistServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// listens in the port of the UDP socket, which may have been picked by
+	// the system.
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &seedlistServer{conn: conn, listener: listener}, nil
+}
+
+// serve answers queries until the server is closed, and waits for the
+// queries being answered.
+func (s *seedlistServer) serve() error {
+	defer s.queries.Wait()
+	errs := make(chan error, 1)
+	go func() {
+		err := s.serveTCP()
+		if err != nil {
+			s.Close()
+		}
+		errs <- err
+	}()
+	err := s.serveUDP()
+	if err != nil {
+		s.Close()
+	}
+	if terr := <-errs; err == nil {
+		err = terr
+	}
+	return err
+}
+
+func (s *seedlistServer) serveUDP() error {
+	for {
+		buf := make([]byte, maxUDPSize)
+		n, addr, err := s.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c := currentConfig()
+		s.queries.Add(1)
+		go func() {
+			defer s.queries.Done()
+			resp, err := answerSeedlist(c, buf[:n], maxUDPSize)
+			if err != nil {
+				log.Printf("invalid DNS query from %s: %s", addr, err)
+				return
+			}
+			if _, err := s.conn.WriteTo(resp, addr); err != nil {
+				log.Printf("failed to answer DNS query from %s: %s", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *seedlistServer) serveTCP() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.queries.Add(1)
+		go func() {
+			defer s.queries.Done()
+			defer conn.Close()
+			s.answerTCP(conn)
+		}()
+	}
+}
+
+// answerTCP answers the queries sent in the given connection, until it's
+// closed by the client or stays idle for the tcpIdleTimeout.
+func (s *seedlistServer) answerTCP(conn net.Conn) {
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, err := answerSeedlist(currentConfig(), query, maxTCPSize)
+		if err != nil {
+			log.Printf("invalid DNS query from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			log.Printf("failed to answer DNS query from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *seedlistServer) Close() error {
+	err := s.conn.Close()
+	if lerr := s.listener.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// answerSeedlist returns the response to the given query, of at most maxSize
+// bytes. SRV queries list the public hosts of the current topology of the
+// cluster, and TXT queries carry its replica set. Responses that don't fit
+// are truncated, and keep the answers that fit.
+// Names of other clusters are unknown to the server.
+func answerSeedlist(c *config, query []byte, maxSize int) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	resp := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+	cluster, ok := c.seedlistCluster(strings.TrimPrefix(name, srvPrefix))
+	var topo topology
+	if !ok {
+		resp.RCode = dnsmessage.RCodeNameError
+	} else if topo, err = clusterTopology(withConfig(context.Background(), c), cluster); err != nil {
+		log.Printf("failed to get the topology of cluster %q: %s", cluster.Name, err)
+		resp.RCode = dnsmessage.RCodeServerFailure
+		ok = false
+	}
+	msg := dnsmessage.Message{Header: resp, Questions: []dnsmessage.Question{q}}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: uint32(c.DNS.TTL.Seconds())}
+	switch {
+	case !ok:
+	case q.Type == dnsmessage.TypeSRV && strings.HasPrefix(name, srvPrefix):
+		rh.Type = dnsmessage.TypeSRV
+		for _, member := range seedlistMembers(topo.Hosts) {
+			target, err := dnsmessage.NewName(member.host + ".")
+			if err != nil {
+				return nil, err
+			}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: rh,
+				Body:   &dnsmessage.SRVResource{Target: target, Port: member.port},
+			})
+		}
+	case q.Type == dnsmessage.TypeTXT && !strings.HasPrefix(name, srvPrefix):
+		if topo.ReplicaSet != "" {
+			rh.Type = dnsmessage.TypeTXT
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: rh,
+				Body:   &dnsmessage.TXTResource{TXT: []string{"replicaSet=" + topo.ReplicaSet}},
+			})
+		}
+	}
+	packed, err := msg.Pack()
+	for err == nil && len(packed) > maxSize && len(msg.Answers) > 0 {
+		msg.Header.Truncated = true
+		msg.Answers = msg.Answers[:len(msg.Answers)-1]
+		packed, err = msg.Pack()
+	}
+	return packed, err
+}
+
+// seedlistMember is a host announced in the seedlist of a cluster.
+type seedlistMember struct {
+	host string
+	port uint16
+}
+
+// seedlistMembers parses the given hosts, in the format host:port, to be
+// announced in a seedlist.
+func seedlistMembers(hosts []string) []seedlistMember {
+	var members []seedlistMember
+	for _, addr := range hosts {
+		member := seedlistMember{host: addr, port: 27017}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+				member = seedlistMember{host: host, port: uint16(p)}
+			}
+		}
+		members = append(members, member)
+	}
+	return members
+}
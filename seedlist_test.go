@@ -0,0 +1,212 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/check.v1"
+)
+
+// startSeedlist starts a seedlist server with the given cluster as the
+// default one, and returns a resolver that queries it.
+func (s *S) startSeedlist(c *check.C, cluster clusterConfig) (*seedlistServer, *net.Resolver) {
+	s.conf.DNS.Listen = "127.0.0.1:0"
+	s.conf.Clusters[0] = cluster
+	c.Assert(s.conf.validate(), check.IsNil)
+	server, err := listenSeedlist(s.conf.DNS.Listen)
+	c.Assert(err, check.IsNil)
+	go server.serve()
+	addr := server.conn.LocalAddr().String()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return server, resolver
+}
+
+func (s *S) TestSeedlistSRV(c *check.C) {
+	server, resolver := s.startSeedlist(c, clusterConfig{
+		Name:       "default",
+		PublicURI:  "mongo1.db.example.com:27017,mongo2.db.example.com:27018",
+		ReplicaSet: "rs0",
+		Seedlist:   "main.db.example.com",
+	})
+	defer server.Close()
+	_, addrs, err := resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.DeepEquals, []*net.SRV{
+		{Target: "mongo1.db.example.com.", Port: 27017},
+		{Target: "mongo2.db.example.com.", Port: 27018},
+	})
+	txt, err := resolver.LookupTXT(context.Background(), "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(txt, check.DeepEquals, []string{"replicaSet=rs0"})
+}
+
+func (s *S) TestSeedlistFollowsTheConfig(c *check.C) {
+	cluster := clusterConfig{
+		Name:      "default",
+		PublicURI: "mongo1.db.example.com",
+		Seedlist:  "main.db.example.com",
+	}
+	server, resolver := s.startSeedlist(c, cluster)
+	defer server.Close()
+	_, addrs, err := resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.DeepEquals, []*net.SRV{{Target: "mongo1.db.example.com.", Port: 27017}})
+	conf := *s.conf
+	conf.Clusters = []clusterConfig{cluster}
+	conf.Clusters[0].PublicURI = "mongo3.db.example.com:27019"
+	setConfig(&conf)
+	_, addrs, err = resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.DeepEquals, []*net.SRV{{Target: "mongo3.db.example.com.", Port: 27019}})
+}
+
+func (s *S) TestSeedlistUnknownName(c *check.C) {
+	server, resolver := s.startSeedlist(c, clusterConfig{
+		Name:      "default",
+		PublicURI: "mongo1.db.example.com",
+		Seedlist:  "main.db.example.com",
+	})
+	defer server.Close()
+	_, _, err := resolver.LookupSRV(context.Background(), "mongodb", "tcp", "other.db.example.com")
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(*net.DNSError).IsNotFound, check.Equals, true)
+	txt, err := resolver.LookupTXT(context.Background(), "main.db.example.com")
+	c.Assert(err, check.NotNil)
+	c.Assert(txt, check.HasLen, 0)
+}
+
+func (s *S) TestAnswerSeedlistInvalidQuery(c *check.C) {
+	_, err := answerSeedlist(s.conf, []byte("not a query"), maxUDPSize)
+	c.Assert(err, check.NotNil)
+}
+
+// srvQuery returns a query for the SRV records of the given seedlist.
+func srvQuery(c *check.C, seedlist string) []byte {
+	name := dnsmessage.MustNewName(srvPrefix + seedlist + ".")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	c.Assert(b.StartQuestions(), check.IsNil)
+	c.Assert(b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}), check.IsNil)
+	query, err := b.Finish()
+	c.Assert(err, check.IsNil)
+	return query
+}
+
+func (s *S) TestAnswerSeedlistTruncated(c *check.C) {
+	var hosts []string
+	for i := 0; i < 30; i++ {
+		hosts = append(hosts, fmt.Sprintf("mongo%02d-with-a-long-name.db.example.com:27017", i))
+	}
+	s.conf.DNS.Listen = "127.0.0.1:0"
+	s.conf.Clusters[0] = clusterConfig{Name: "default", PublicURI: strings.Join(hosts, ","), Seedlist: "main.db.example.com"}
+	c.Assert(s.conf.validate(), check.IsNil)
+	query := srvQuery(c, "main.db.example.com")
+	resp, err := answerSeedlist(s.conf, query, maxUDPSize)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(resp) <= maxUDPSize, check.Equals, true)
+	var msg dnsmessage.Message
+	c.Assert(msg.Unpack(resp), check.IsNil)
+	c.Assert(msg.Header.Truncated, check.Equals, true)
+	c.Assert(len(msg.Answers) < len(hosts), check.Equals, true)
+	resp, err = answerSeedlist(s.conf, query, maxTCPSize)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Unpack(resp), check.IsNil)
+	c.Assert(msg.Header.Truncated, check.Equals, false)
+	c.Assert(msg.Answers, check.HasLen, len(hosts))
+}
+
+func (s *S) TestSeedlistTruncatedAnswerRetriedOverTCP(c *check.C) {
+	var hosts []string
+	for i := 0; i < 30; i++ {
+		hosts = append(hosts, fmt.Sprintf("mongo%02d-with-a-long-name.db.example.com:27017", i))
+	}
+	server, resolver := s.startSeedlist(c, clusterConfig{
+		Name:      "default",
+		PublicURI: strings.Join(hosts, ","),
+		Seedlist:  "main.db.example.com",
+	})
+	defer server.Close()
+	_, addrs, err := resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.HasLen, len(hosts))
+}
+
+// slowCluster is a fakeCluster whose topology is only returned after release
+// is closed. It signals in started when the topology is requested.
+type slowCluster struct {
+	*fakeCluster
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f slowCluster) Topology(ctx context.Context) (topology, error) {
+	close(f.started)
+	<-f.release
+	return f.fakeCluster.Topology(ctx)
+}
+
+func (s *S) TestSeedlistSlowClusterDoesntDelayOthers(c *check.C) {
+	s.conf.Clusters = append(s.conf.Clusters, clusterConfig{
+		Name:      "slow",
+		PublicURI: "slow1.slow.example.com",
+		Seedlist:  "main.slow.example.com",
+		Discover:  true,
+	})
+	started, release := make(chan struct{}), make(chan struct{})
+	newCluster = func(conf clusterConfig) Cluster {
+		if conf.Name == "slow" {
+			return slowCluster{fakeCluster: s.cluster, started: started, release: release}
+		}
+		return s.cluster
+	}
+	server, resolver := s.startSeedlist(c, clusterConfig{
+		Name:      "default",
+		PublicURI: "mongo1.db.example.com",
+		Seedlist:  "main.db.example.com",
+	})
+	defer server.Close()
+	conn, err := net.Dial("udp", server.conn.LocalAddr().String())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write(srvQuery(c, "main.slow.example.com"))
+	c.Assert(err, check.IsNil)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, addrs, err := resolver.LookupSRV(ctx, "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.DeepEquals, []*net.SRV{{Target: "mongo1.db.example.com.", Port: 27017}})
+	close(release)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, maxUDPSize))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestBindWithSeedlist(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.conf.DNS.Listen = "127.0.0.1:5353"
+	s.conf.Clusters[0].PublicURI = "mongo1.db.example.com,mongo2.db.example.com"
+	s.conf.Clusters[0].Seedlist = "main.db.example.com"
+	s.conf.Clusters[0].TLS.Enabled = true
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(env["MONGODB_HOSTS"], check.Equals, "mongo1.db.example.com,mongo2.db.example.com")
+	conn, err := parseConnString(env["MONGODB_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.SRV, check.Equals, true)
+	c.Assert(conn.Hosts, check.DeepEquals, []string{"main.db.example.com"})
+	c.Assert(conn.get("tls"), check.Equals, "true")
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// logWriter writes to the standard logger.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// service is the running API, along with its background jobs.
+type service struct {
+	server *http.Server
+	dns    *seedlistServer
+	// stop is closed to stop the background jobs, which are tracked in jobs.
+	stop chan struct{}
+	jobs sync.WaitGroup
+}
+
+// serve runs the service API with the given config, after applying the
+// pending migrations, reloading the config file when it changes. It returns
+// after a SIGINT or SIGTERM, once the API is shut down.
+func serve(c *config) error {
+	if err := migrate(context.Background(), logWriter{}); err != nil {
+		return err
+	}
+	s := &service{
+		server: &http.Server{Addr: c.Listen, Handler: buildMux()},
+		stop:   make(chan struct{}),
+	}
+	if configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		s.jobs.Add(1)
+		go func() {
+			defer s.jobs.Done()
+			watchConfig(configPath, configCheckInterval, hup, s.stop)
+		}()
+	}
+	if c.DNS.Listen != "" {
+		dns, err := listenSeedlist(c.DNS.Listen)
+		if err != nil {
+			return err
+		}
+		s.dns = dns
+		s.jobs.Add(1)
+		go func() {
+			defer s.jobs.Done()
+			if err := dns.serve(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if c.TLS.CertFile != "" {
+			loader := &tlsLoader{}
+			if _, err := loader.config(); err != nil {
+				errs <- err
+				return
+			}
+			s.server.TLSConfig = serverTLSConfig(loader)
+			errs <- s.server.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- s.server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	}
+	return s.shutdown()
+}
+
+// shutdown stops accepting connections, and waits for the running requests
+// and background jobs for the shutdown-timeout in the config. Then the locks
+// still held are released, and the store and the clients are closed.
+func (s *service) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig().ShutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("stopped waiting for running requests: %s", err)
+	}
+	if s.dns != nil {
+		s.dns.Close()
+	}
+	close(s.stop)
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Print("stopped waiting for background jobs")
+		err = ctx.Err()
+	}
+	releaseLocks()
+	if cerr := getStore().Close(); cerr != nil {
+		log.Printf("failed to close the store: %s", cerr)
+	}
+	closeAllClients()
+	return err
+}
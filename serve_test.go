@@ -0,0 +1,87 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// startService runs a service and sends it a request, which locks myapp and
+// waits for release to be closed.
+func (s *S) startService(c *check.C, release chan struct{}) (*service, chan error) {
+	locked := make(chan bool)
+	svc := &service{stop: make(chan struct{})}
+	svc.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := lock(context.Background(), "myapp"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer unlock(context.Background(), "myapp")
+		locked <- true
+		<-release
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	go svc.server.Serve(l)
+	results := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		results <- err
+	}()
+	select {
+	case <-locked:
+	case err := <-results:
+		c.Fatalf("the request didn't lock myapp: %v", err)
+	}
+	return svc, results
+}
+
+func (s *S) TestShutdownWaitsForRequests(c *check.C) {
+	release := make(chan struct{})
+	svc, results := s.startService(c, release)
+	stopped := make(chan bool)
+	svc.jobs.Add(1)
+	go func() {
+		defer svc.jobs.Done()
+		<-svc.stop
+		stopped <- true
+	}()
+	shutdown := make(chan error)
+	go func() { shutdown <- svc.shutdown() }()
+	select {
+	case <-shutdown:
+		c.Fatal("shutdown didn't wait for the running request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	c.Assert(<-results, check.IsNil)
+	c.Assert(<-stopped, check.Equals, true)
+	c.Assert(<-shutdown, check.IsNil)
+	c.Assert(s.store.locks, check.HasLen, 0)
+}
+
+func (s *S) TestShutdownTimeout(c *check.C) {
+	s.conf.ShutdownTimeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	svc, results := s.startService(c, release)
+	err := svc.shutdown()
+	heldMut.Lock()
+	held := len(heldLocks)
+	heldMut.Unlock()
+	locked, _ := s.store.Lock(context.Background(), "myapp")
+	close(release)
+	c.Assert(<-results, check.IsNil)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+	c.Assert(held, check.Equals, 0)
+	c.Assert(locked, check.Equals, true)
+}
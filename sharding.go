@@ -0,0 +1,61 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// chunkDistribution is the number of chunks of each sharded collection of a
+// database in each shard, keyed by collection and then by shard.
+type chunkDistribution map[string]map[string]int
+
+// enableSharding enables sharding for the given database in the cluster,
+// with the primary shard picked by the plan, and returns the primary shard
+// requested, if any.
+func enableSharding(ctx context.Context, cluster clusterConfig, plan planConfig, db string) (string, error) {
+	c := newCluster(cluster)
+	primary := plan.Sharding.PrimaryShard
+	if zone := plan.Sharding.Zone; zone != "" {
+		shards, err := c.ZoneShards(ctx, zone)
+		if err != nil {
+			return "", err
+		}
+		if len(shards) == 0 {
+			return "", fmt.Errorf("no shards in zone %q", zone)
+		}
+		primary = shards[0]
+	}
+	return primary, c.EnableSharding(ctx, db, primary)
+}
+
+// format formats the distribution of the given collection as a list of
+// shard: chunks, sorted by shard.
+func (d chunkDistribution) format(collection string) string {
+	shards := make([]string, 0, len(d[collection]))
+	for shard := range d[collection] {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	parts := make([]string, len(shards))
+	for i, shard := range shards {
+		parts[i] = fmt.Sprintf("%s: %d", shard, d[collection][shard])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// collections returns the sharded collections in the distribution, sorted by
+// name.
+func (d chunkDistribution) collections() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
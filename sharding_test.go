@@ -0,0 +1,111 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) add(c *check.C, name, plan string) *httptest.ResponseRecorder {
+	body := strings.NewReader("name=" + name + "&plan=" + plan)
+	request, err := http.NewRequest("POST", "/resources", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func (s *S) info(c *check.C, name string) []infoItem {
+	request, err := http.NewRequest("GET", "/resources/"+name, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var info []infoItem
+	err = json.NewDecoder(recorder.Body).Decode(&info)
+	c.Assert(err, check.IsNil)
+	return info
+}
+
+func (s *S) TestAddWithSharding(c *check.C) {
+	s.conf.Plans = []planConfig{
+		{Name: "small", Cluster: "default"},
+		{Name: "sharded", Cluster: "default", Sharding: shardingConfig{Enabled: true, PrimaryShard: "shard0001"}},
+	}
+	c.Assert(s.add(c, "myapp", "sharded").Code, check.Equals, http.StatusCreated)
+	c.Assert(s.add(c, "other", "small").Code, check.Equals, http.StatusCreated)
+	c.Assert(s.cluster.sharded, check.DeepEquals, map[string]string{"myapp": "shard0001"})
+	instance, err := s.store.GetInstance(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Sharded, check.Equals, true)
+	c.Assert(instance.PrimaryShard, check.Equals, "shard0001")
+}
+
+func (s *S) TestAddWithShardingZone(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "eu", Cluster: "default", Sharding: shardingConfig{Enabled: true, Zone: "EU"}}}
+	s.cluster.zones["EU"] = []string{"shard0002", "shard0003"}
+	c.Assert(s.add(c, "myapp", "eu").Code, check.Equals, http.StatusCreated)
+	c.Assert(s.cluster.sharded, check.DeepEquals, map[string]string{"myapp": "shard0002"})
+	delete(s.cluster.zones, "EU")
+	recorder := s.add(c, "another", "eu")
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+	_, err := s.store.GetInstance(context.Background(), "another")
+	c.Assert(err, check.Equals, errNotFound)
+}
+
+func (s *S) TestAddWithShardingFailure(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "sharded", Cluster: "default", Sharding: shardingConfig{Enabled: true}}}
+	s.cluster.fail("EnableSharding", errors.New("no such command: 'enableSharding'"))
+	recorder := s.add(c, "myapp", "sharded")
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+	c.Assert(s.store.instances, check.HasLen, 0)
+}
+
+func (s *S) TestInfo(c *check.C) {
+	s.conf.Plans = []planConfig{{Name: "small", Cluster: "default"}}
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small"})
+	c.Assert(s.info(c, "myapp"), check.DeepEquals, []infoItem{
+		{Label: "Cluster", Value: "default"},
+		{Label: "Database", Value: "myapp"},
+		{Label: "Plan", Value: "small"},
+	})
+}
+
+func (s *S) TestInfoSharded(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "my.app", Database: "my_app", Sharded: true, PrimaryShard: "shard0001"})
+	s.cluster.chunks["my_app"] = chunkDistribution{
+		"my_app.users":  {"shard0001": 4, "shard0000": 3},
+		"my_app.events": {"shard0001": 10},
+	}
+	c.Assert(s.info(c, "my.app"), check.DeepEquals, []infoItem{
+		{Label: "Cluster", Value: "default"},
+		{Label: "Database", Value: "my_app"},
+		{Label: "Sharding", Value: "enabled, primary shard shard0001"},
+		{Label: "Chunks of my_app.events", Value: "shard0001: 10"},
+		{Label: "Chunks of my_app.users", Value: "shard0000: 3, shard0001: 4"},
+	})
+}
+
+func (s *S) TestInfoChunkDistributionFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp", Sharded: true})
+	s.cluster.fail("ChunkDistribution", errors.New("not authorized on config"))
+	request, err := http.NewRequest("GET", "/resources/myapp", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.muxer.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(recorder.Body.String(), check.Equals, jsonError("internal-error", "Internal error"))
+}
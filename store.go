@@ -0,0 +1,176 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockTTL is the amount of time a lock is held before being considered stale,
+// so a crashed process does not hold an instance forever.
+const lockTTL = 5 * time.Minute
+
+var (
+	errNotFound = errors.New("not found")
+	// errDatabaseInUse is returned when adding an instance whose database
+	// is the database of another instance in the same cluster.
+	errDatabaseInUse = errors.New("the database is in use by another instance")
+)
+
+// Store is the storage used for the metadata of the service: instances,
+// binds, audit entries, revoked certificates and locks.
+type Store interface {
+	// AddInstance returns errInstanceExists when the name is taken, and
+	// errDatabaseInUse when the database belongs to another instance.
+	AddInstance(ctx context.Context, instance dbInstance) error
+	GetInstance(ctx context.Context, name string) (dbInstance, error)
+	ListInstances(ctx context.Context) ([]dbInstance, error)
+	RemoveInstance(ctx context.Context, name string) error
+
+	AddBind(ctx context.Context, bind dbBind) error
+	GetBind(ctx context.Context, name, appHost, kind string) (dbBind, error)
+	ListBinds(ctx context.Context, name string) ([]dbBind, error)
+	// ListAllBinds returns the binds of every instance, including the ones
+	// created before instances were stored.
+	ListAllBinds(ctx context.Context) ([]dbBind, error)
+	RemoveBind(ctx context.Context, bind dbBind) error
+	RemoveBinds(ctx context.Context, name string) error
+
+	AddAuditEntry(ctx context.Context, entry auditEntry) error
+	ListAuditEntries(ctx context.Context, name string) ([]auditEntry, error)
+
+	AddRevocation(ctx context.Context, revocation dbRevocation) error
+	ListRevocations(ctx context.Context, cluster string) ([]dbRevocation, error)
+
+	// AddMigration records a migration applied to the store, and
+	// ListMigrations returns the applied ones, sorted by version.
+	AddMigration(ctx context.Context, migration dbMigration) error
+	ListMigrations(ctx context.Context) ([]dbMigration, error)
+
+	// Lock tries to acquire the lock for the given name, returning false
+	// when it's held by someone else.
+	Lock(ctx context.Context, name string) (bool, error)
+	Unlock(ctx context.Context, name string) error
+
+	Close() error
+}
+
+// dbInstance represents a service instance stored in the database.
+type dbInstance struct {
+	Name      string    `bson:",omitempty"`
+	Plan      string    `bson:",omitempty"`
+	CreatedAt time.Time `bson:",omitempty"`
+	// Sharded tells whether sharding was enabled for the database, and
+	// PrimaryShard is the primary shard requested by the plan.
+	Sharded      bool   `bson:",omitempty"`
+	PrimaryShard string `bson:",omitempty"`
+	// Cluster is the name of the cluster that hosts the instance, and
+	// Database is the name of its database in the cluster.
+	Cluster  string `bson:",omitempty"`
+	Database string `bson:",omitempty"`
+	// Team is the tsuru team that owns the instance.
+	Team string `bson:",omitempty"`
+}
+
+// database returns the name of the database of the instance. Instances
+// created before names were mapped use their name.
+func (i dbInstance) database() string {
+	if i.Database != "" {
+		return i.Database
+	}
+	return i.Name
+}
+
+// sameDatabase tells whether the given instances have the same database in
+// the same cluster. Names are compared ignoring case, like MongoDB does.
+// Instances created before databases were recorded are ignored.
+func sameDatabase(a, b dbInstance) bool {
+	return a.Database != "" && a.Cluster == b.Cluster && strings.EqualFold(a.Database, b.Database)
+}
+
+// auditEntry represents an action performed in a service instance.
+type auditEntry struct {
+	Instance string    `bson:",omitempty"`
+	Action   string    `bson:",omitempty"`
+	AppHost  string    `bson:",omitempty"`
+	Time     time.Time `bson:",omitempty"`
+}
+
+// dbRevocation represents a client certificate revoked in a cluster.
+type dbRevocation struct {
+	Cluster string    `bson:",omitempty"`
+	Serial  string    `bson:",omitempty"`
+	Time    time.Time `bson:",omitempty"`
+}
+
+// dbMigration represents a migration applied to the store.
+type dbMigration struct {
+	Version int       `bson:"_id"`
+	Name    string    `bson:",omitempty"`
+	Time    time.Time `bson:",omitempty"`
+}
+
+// dbLock represents a lock held on an instance.
+type dbLock struct {
+	Name    string    `bson:"_id"`
+	Owner   string    `bson:",omitempty"`
+	Expires time.Time `bson:",omitempty"`
+}
+
+var (
+	currentStore Store
+	storeMut     sync.Mutex
+	lockOwner    = newLockOwner()
+)
+
+// getStore returns the store in use, creating it on first use according to
+// the metadata config.
+func getStore() Store {
+	storeMut.Lock()
+	defer storeMut.Unlock()
+	if currentStore == nil {
+		var err error
+		currentStore, err = newStore(currentConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return currentStore
+}
+
+// newStore returns the store of the given config. The mongodb store keeps
+// using the default cluster of c when the config is reloaded, like the rest
+// of the metadata settings.
+func newStore(c *config) (Store, error) {
+	switch c.Metadata.Store {
+	case "mongodb":
+		return &mongoStore{cluster: c.Clusters[0]}, nil
+	case "bolt":
+		return newBoltStore(c.Metadata.Path)
+	}
+	return nil, fmt.Errorf("unknown store %q", c.Metadata.Store)
+}
+
+func audit(ctx context.Context, instance, action, appHost string) {
+	entry := auditEntry{Instance: instance, Action: action, AppHost: appHost, Time: time.Now().UTC()}
+	if err := getStore().AddAuditEntry(ctx, entry); err != nil {
+		log.Printf("failed to record %s of %q in the audit log: %s", action, instance, err)
+	}
+}
+
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	var random [4]byte
+	rand.Read(random[:])
+	return fmt.Sprintf("%s-%d-%x", host, os.Getpid(), random)
+}
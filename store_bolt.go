@@ -0,0 +1,362 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	instancesBucket   = []byte("instances")
+	bindsBucket       = []byte("binds")
+	auditBucket       = []byte("audit")
+	locksBucket       = []byte("locks")
+	revocationsBucket = []byte("revocations")
+	migrationsBucket  = []byte("migrations")
+)
+
+// errStopScan is used to stop a scan before reaching the end of the prefix.
+var errStopScan = errors.New("stop scan")
+
+// boltStore is a Store that keeps the metadata in a local BoltDB file, so the
+// service metadata doesn't live in the MongoDB server it manages.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// newBoltStore opens the given file, which only one process may have open at
+// a time: commands fail while the API is running with the same file.
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err == bbolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process, like the API: the bolt store can't be shared", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{instancesBucket, bindsBucket, auditBucket, locksBucket, revocationsBucket, migrationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// key joins the given parts in a key that can be used for prefix scans.
+func key(parts ...string) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.WriteString(p)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func (s *boltStore) put(bucket, k []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put(k, data)
+	})
+}
+
+// scan calls fn for each value in bucket whose key starts with prefix,
+// stopping at the first error.
+func (s *boltStore) scan(bucket, prefix []byte, fn func(k, v []byte) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AddInstance(ctx context.Context, instance dbInstance) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(instancesBucket)
+		if b.Get(key(instance.Name)) != nil {
+			return errInstanceExists
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			var existing dbInstance
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			if sameDatabase(existing, instance) {
+				return errDatabaseInUse
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(key(instance.Name), data)
+	})
+}
+
+func (s *boltStore) GetInstance(ctx context.Context, name string) (dbInstance, error) {
+	var instance dbInstance
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(instancesBucket).Get(key(name))
+		if data == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(data, &instance)
+	})
+	return instance, err
+}
+
+func (s *boltStore) ListInstances(ctx context.Context) ([]dbInstance, error) {
+	var instances []dbInstance
+	err := s.scan(instancesBucket, nil, func(k, v []byte) error {
+		var instance dbInstance
+		if err := json.Unmarshal(v, &instance); err != nil {
+			return err
+		}
+		instances = append(instances, instance)
+		return nil
+	})
+	return instances, err
+}
+
+func (s *boltStore) RemoveInstance(ctx context.Context, name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(instancesBucket)
+		if b.Get(key(name)) == nil {
+			return errNotFound
+		}
+		return b.Delete(key(name))
+	})
+}
+
+// AddBind rejects binds of an app that already has one of the same kind in
+// the instance, like the unique index of the mongodb store.
+func (s *boltStore) AddBind(ctx context.Context, bind dbBind) error {
+	data, err := json.Marshal(bind)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bindsBucket)
+		c := b.Cursor()
+		prefix := key(bind.Name, bind.AppHost)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var existing dbBind
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			if existing.Kind == bind.Kind {
+				return errAlreadyBound
+			}
+		}
+		return b.Put(key(bind.Name, bind.AppHost, bind.User), data)
+	})
+}
+
+func (s *boltStore) GetBind(ctx context.Context, name, appHost, kind string) (dbBind, error) {
+	var bind dbBind
+	err := s.scan(bindsBucket, key(name, appHost), func(k, v []byte) error {
+		if err := json.Unmarshal(v, &bind); err != nil {
+			return err
+		}
+		if bind.Kind != kind {
+			return nil
+		}
+		return errStopScan
+	})
+	if err == errStopScan {
+		return bind, nil
+	}
+	if err == nil {
+		err = errNotFound
+	}
+	return bind, err
+}
+
+func (s *boltStore) ListBinds(ctx context.Context, name string) ([]dbBind, error) {
+	var binds []dbBind
+	err := s.scan(bindsBucket, key(name), func(k, v []byte) error {
+		var bind dbBind
+		if err := json.Unmarshal(v, &bind); err != nil {
+			return err
+		}
+		binds = append(binds, bind)
+		return nil
+	})
+	return binds, err
+}
+
+func (s *boltStore) ListAllBinds(ctx context.Context) ([]dbBind, error) {
+	var binds []dbBind
+	err := s.scan(bindsBucket, nil, func(k, v []byte) error {
+		var bind dbBind
+		if err := json.Unmarshal(v, &bind); err != nil {
+			return err
+		}
+		binds = append(binds, bind)
+		return nil
+	})
+	return binds, err
+}
+
+func (s *boltStore) RemoveBind(ctx context.Context, bind dbBind) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bindsBucket)
+		k := key(bind.Name, bind.AppHost, bind.User)
+		if b.Get(k) == nil {
+			return errNotFound
+		}
+		return b.Delete(k)
+	})
+}
+
+func (s *boltStore) RemoveBinds(ctx context.Context, name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bindsBucket).Cursor()
+		prefix := key(name)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AddAuditEntry(ctx context.Context, entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], seq)
+		return b.Put(append(key(entry.Instance), id[:]...), data)
+	})
+}
+
+func (s *boltStore) ListAuditEntries(ctx context.Context, name string) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := s.scan(auditBucket, key(name), func(k, v []byte) error {
+		var entry auditEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (s *boltStore) AddRevocation(ctx context.Context, revocation dbRevocation) error {
+	return s.put(revocationsBucket, key(revocation.Cluster, revocation.Serial), revocation)
+}
+
+func (s *boltStore) ListRevocations(ctx context.Context, cluster string) ([]dbRevocation, error) {
+	var revocations []dbRevocation
+	err := s.scan(revocationsBucket, key(cluster), func(k, v []byte) error {
+		var revocation dbRevocation
+		if err := json.Unmarshal(v, &revocation); err != nil {
+			return err
+		}
+		revocations = append(revocations, revocation)
+		return nil
+	})
+	return revocations, err
+}
+
+func (s *boltStore) AddMigration(ctx context.Context, migration dbMigration) error {
+	var version [8]byte
+	binary.BigEndian.PutUint64(version[:], uint64(migration.Version))
+	return s.put(migrationsBucket, version[:], migration)
+}
+
+func (s *boltStore) ListMigrations(ctx context.Context) ([]dbMigration, error) {
+	var migrations []dbMigration
+	err := s.scan(migrationsBucket, nil, func(k, v []byte) error {
+		var migration dbMigration
+		if err := json.Unmarshal(v, &migration); err != nil {
+			return err
+		}
+		migrations = append(migrations, migration)
+		return nil
+	})
+	return migrations, err
+}
+
+func (s *boltStore) Lock(ctx context.Context, name string) (bool, error) {
+	var acquired bool
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		now := time.Now().UTC()
+		if data := b.Get(key(name)); data != nil {
+			var lock dbLock
+			if err := json.Unmarshal(data, &lock); err != nil {
+				return err
+			}
+			if lock.Expires.After(now) {
+				return nil
+			}
+		}
+		data, err := json.Marshal(dbLock{Name: name, Owner: lockOwner, Expires: now.Add(lockTTL)})
+		if err != nil {
+			return err
+		}
+		acquired = true
+		return b.Put(key(name), data)
+	})
+	return acquired, err
+}
+
+func (s *boltStore) Unlock(ctx context.Context, name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		data := b.Get(key(name))
+		if data == nil {
+			return nil
+		}
+		var lock dbLock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return err
+		}
+		if lock.Owner != lockOwner {
+			return nil
+		}
+		return b.Delete(key(name))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
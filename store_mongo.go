@@ -0,0 +1,318 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is a Store that keeps the metadata in the MongoDB server managed
+// by the service, in the database returned by dbName.
+type mongoStore struct {
+	// cluster is the default cluster when the store was created, which
+	// doesn't follow reloads, so locks are always in the same server.
+	cluster clusterConfig
+}
+
+// run runs op with the given collection, bound to ctx.
+func (s *mongoStore) run(ctx context.Context, name string, op func(context.Context, *mongo.Collection) error) error {
+	return withClient(ctx, s.cluster, func(ctx context.Context, client *mongo.Client) error {
+		return op(ctx, client.Database(dbName()).Collection(name))
+	})
+}
+
+// insert inserts doc in the given collection.
+func (s *mongoStore) insert(ctx context.Context, name string, doc interface{}) error {
+	return s.run(ctx, name, func(ctx context.Context, c *mongo.Collection) error {
+		_, err := c.InsertOne(ctx, doc)
+		return err
+	})
+}
+
+// findOne decodes into result the first document of the given collection
+// matching filter.
+func (s *mongoStore) findOne(ctx context.Context, name string, filter interface{}, result interface{}) error {
+	return notFound(s.run(ctx, name, func(ctx context.Context, c *mongo.Collection) error {
+		return c.FindOne(ctx, filter).Decode(result)
+	}))
+}
+
+// findAll decodes into results the documents of the given collection
+// matching filter, sorted by the given keys.
+func (s *mongoStore) findAll(ctx context.Context, name string, filter interface{}, results interface{}, sort ...string) error {
+	opts := options.Find()
+	if len(sort) > 0 {
+		keys := make(bson.D, len(sort))
+		for i, key := range sort {
+			keys[i] = bson.E{Key: key, Value: 1}
+		}
+		opts.SetSort(keys)
+	}
+	return s.run(ctx, name, func(ctx context.Context, c *mongo.Collection) error {
+		cursor, err := c.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, results)
+	})
+}
+
+// removeOne removes the first document of the given collection matching
+// filter, returning errNotFound when there's none.
+func (s *mongoStore) removeOne(ctx context.Context, name string, filter interface{}) error {
+	return s.run(ctx, name, func(ctx context.Context, c *mongo.Collection) error {
+		result, err := c.DeleteOne(ctx, filter)
+		if err == nil && result.DeletedCount == 0 {
+			return errNotFound
+		}
+		return err
+	})
+}
+
+func (s *mongoStore) AddInstance(ctx context.Context, instance dbInstance) error {
+	err := s.insert(ctx, "instances", instance)
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	// the name and the database have unique indexes.
+	if _, err := s.GetInstance(ctx, instance.Name); err == nil {
+		return errInstanceExists
+	}
+	return errDatabaseInUse
+}
+
+func (s *mongoStore) GetInstance(ctx context.Context, name string) (dbInstance, error) {
+	var instance dbInstance
+	err := s.findOne(ctx, "instances", bson.M{"name": name}, &instance)
+	return instance, err
+}
+
+func (s *mongoStore) ListInstances(ctx context.Context) ([]dbInstance, error) {
+	var instances []dbInstance
+	err := s.findAll(ctx, "instances", bson.M{}, &instances, "name")
+	return instances, err
+}
+
+func (s *mongoStore) RemoveInstance(ctx context.Context, name string) error {
+	return s.removeOne(ctx, "instances", bson.M{"name": name})
+}
+
+func (s *mongoStore) AddBind(ctx context.Context, bind dbBind) error {
+	err := s.insert(ctx, "bind", bind)
+	if mongo.IsDuplicateKeyError(err) {
+		return errAlreadyBound
+	}
+	return err
+}
+
+func (s *mongoStore) GetBind(ctx context.Context, name, appHost, kind string) (dbBind, error) {
+	var bind dbBind
+	query := bson.M{"name": name, "apphost": appHost, "kind": kind}
+	if kind == "" {
+		// matches binds created before kinds were introduced.
+		query["kind"] = nil
+	}
+	err := s.findOne(ctx, "bind", query, &bind)
+	return bind, err
+}
+
+func (s *mongoStore) ListBinds(ctx context.Context, name string) ([]dbBind, error) {
+	var binds []dbBind
+	err := s.findAll(ctx, "bind", bson.M{"name": name}, &binds)
+	return binds, err
+}
+
+func (s *mongoStore) ListAllBinds(ctx context.Context) ([]dbBind, error) {
+	var binds []dbBind
+	err := s.findAll(ctx, "bind", bson.M{}, &binds, "name", "apphost")
+	return binds, err
+}
+
+func (s *mongoStore) RemoveBind(ctx context.Context, bind dbBind) error {
+	return s.removeOne(ctx, "bind", bind)
+}
+
+func (s *mongoStore) RemoveBinds(ctx context.Context, name string) error {
+	return s.run(ctx, "bind", func(ctx context.Context, c *mongo.Collection) error {
+		_, err := c.DeleteMany(ctx, bson.M{"name": name})
+		return err
+	})
+}
+
+func (s *mongoStore) AddAuditEntry(ctx context.Context, entry auditEntry) error {
+	return s.insert(ctx, "audit", entry)
+}
+
+func (s *mongoStore) ListAuditEntries(ctx context.Context, name string) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := s.findAll(ctx, "audit", bson.M{"instance": name}, &entries, "time")
+	return entries, err
+}
+
+// AddRevocation ignores certificates already revoked, as removing a user is
+// retried when it fails.
+func (s *mongoStore) AddRevocation(ctx context.Context, revocation dbRevocation) error {
+	err := s.insert(ctx, "revocations", revocation)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *mongoStore) ListRevocations(ctx context.Context, cluster string) ([]dbRevocation, error) {
+	var revocations []dbRevocation
+	err := s.findAll(ctx, "revocations", bson.M{"cluster": cluster}, &revocations, "time")
+	return revocations, err
+}
+
+func (s *mongoStore) AddMigration(ctx context.Context, migration dbMigration) error {
+	return s.insert(ctx, "migrations", migration)
+}
+
+func (s *mongoStore) ListMigrations(ctx context.Context) ([]dbMigration, error) {
+	var migrations []dbMigration
+	err := s.findAll(ctx, "migrations", bson.M{}, &migrations, "_id")
+	return migrations, err
+}
+
+// ensureIndexes creates the indexes of the metadata collections. Binds are
+// unique per app and kind, as an app may have both a read-only and a
+// read-write bind to an instance. Documents stored before the indexes existed
+// may be duplicated: only the newest one of each is kept, and the removed
+// ones are reported to w.
+func (s *mongoStore) ensureIndexes(ctx context.Context, w io.Writer) error {
+	indexes := []struct {
+		collection string
+		key        []string
+		unique     bool
+	}{
+		{"bind", []string{"name", "apphost", "kind"}, true},
+		{"instances", []string{"name"}, true},
+		{"audit", []string{"instance", "time"}, false},
+		{"revocations", []string{"cluster", "serial"}, true},
+	}
+	for _, i := range indexes {
+		keys := make(bson.D, len(i.key))
+		for j, key := range i.key {
+			keys[j] = bson.E{Key: key, Value: 1}
+		}
+		if i.unique {
+			if err := s.removeDuplicates(ctx, i.collection, i.key, w); err != nil {
+				return fmt.Errorf("failed to remove duplicates of %v in %s: %s", i.key, i.collection, err)
+			}
+		}
+		err := s.run(ctx, i.collection, func(ctx context.Context, c *mongo.Collection) error {
+			_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: options.Index().SetUnique(i.unique)})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create index %v in %s: %s", i.key, i.collection, err)
+		}
+	}
+	return nil
+}
+
+// ensureDatabaseIndex creates the index that keeps the databases of
+// instances unique in each cluster, ignoring case like MongoDB does.
+// Instances created before databases were recorded aren't indexed.
+func (s *mongoStore) ensureDatabaseIndex(ctx context.Context) error {
+	opts := options.Index().
+		SetUnique(true).
+		SetCollation(&options.Collation{Locale: "en", Strength: 2}).
+		SetPartialFilterExpression(bson.M{"database": bson.M{"$exists": true}})
+	keys := bson.D{{Key: "cluster", Value: 1}, {Key: "database", Value: 1}}
+	return s.run(ctx, "instances", func(ctx context.Context, c *mongo.Collection) error {
+		_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+		return err
+	})
+}
+
+// removeDuplicates removes the documents of the given collection that have
+// the same values in the given keys as a newer one, which is kept.
+func (s *mongoStore) removeDuplicates(ctx context.Context, collection string, key []string, w io.Writer) error {
+	group := make(bson.D, len(key))
+	for i, k := range key {
+		group[i] = bson.E{Key: k, Value: "$" + k}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	}
+	return s.run(ctx, collection, func(ctx context.Context, c *mongo.Collection) error {
+		cursor, err := c.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		var duplicates []struct {
+			Key bson.M        `bson:"_id"`
+			IDs []interface{} `bson:"ids"`
+		}
+		if err := cursor.All(ctx, &duplicates); err != nil {
+			return err
+		}
+		for _, d := range duplicates {
+			// ids are sorted from the newest to the oldest.
+			_, err := c.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": d.IDs[1:]}})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s: removed %d duplicates of %v, keeping the newest one\n", collection, len(d.IDs)-1, d.Key)
+		}
+		return nil
+	})
+}
+
+func (s *mongoStore) Lock(ctx context.Context, name string) (bool, error) {
+	var acquired bool
+	err := s.run(ctx, "locks", func(ctx context.Context, c *mongo.Collection) error {
+		now := time.Now().UTC()
+		_, err := c.InsertOne(ctx, dbLock{Name: name, Owner: lockOwner, Expires: now.Add(lockTTL)})
+		if err == nil || !mongo.IsDuplicateKeyError(err) {
+			acquired = err == nil
+			return err
+		}
+		result, err := c.UpdateOne(ctx,
+			bson.M{"_id": name, "expires": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": lockOwner, "expires": now.Add(lockTTL)}},
+		)
+		if err != nil {
+			return err
+		}
+		acquired = result.MatchedCount > 0
+		return nil
+	})
+	return acquired, err
+}
+
+func (s *mongoStore) Unlock(ctx context.Context, name string) error {
+	return s.run(ctx, "locks", func(ctx context.Context, c *mongo.Collection) error {
+		_, err := c.DeleteOne(ctx, bson.M{"_id": name, "owner": lockOwner})
+		return err
+	})
+}
+
+func (s *mongoStore) Close() error {
+	return nil
+}
+
+// notFound translates mongo.ErrNoDocuments into errNotFound.
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errNotFound
+	}
+	return err
+}
@@ -0,0 +1,282 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// stores returns one empty instance of each local Store implementation.
+func (s *S) stores(c *check.C) []Store {
+	bolt, err := newBoltStore(filepath.Join(c.MkDir(), "mongoapi.db"))
+	c.Assert(err, check.IsNil)
+	return []Store{bolt, newFakeStore()}
+}
+
+func (s *MongoSuite) stores(c *check.C) []Store {
+	store := &mongoStore{cluster: currentConfig().Clusters[0]}
+	for _, name := range []string{"instances", "audit", "locks", "revocations", "migrations"} {
+		testDatabase(c, dbName()).Collection(name).Drop(context.Background())
+	}
+	c.Assert(store.ensureIndexes(context.Background(), &bytes.Buffer{}), check.IsNil)
+	c.Assert(store.ensureDatabaseIndex(context.Background()), check.IsNil)
+	return []Store{store}
+}
+
+func (s *MongoSuite) TestMongoStoreIndexesRemoveDuplicates(c *check.C) {
+	binds := testDatabase(c, dbName()).Collection("bind")
+	c.Assert(binds.Drop(context.Background()), check.IsNil)
+	for _, user := range []string{"myapp01234567", "myapp89abcdef", "myappfedcba98"} {
+		_, err := binds.InsertOne(context.Background(), dbBind{Name: "myapp", AppHost: "app1", User: user})
+		c.Assert(err, check.IsNil)
+	}
+	_, err := binds.InsertOne(context.Background(), dbBind{Name: "myapp", AppHost: "app1", User: "myapp76543210", Kind: readBind})
+	c.Assert(err, check.IsNil)
+	var out bytes.Buffer
+	store := &mongoStore{cluster: currentConfig().Clusters[0]}
+	c.Assert(store.ensureIndexes(context.Background(), &out), check.IsNil)
+	c.Assert(out.String(), check.Equals, "bind: removed 2 duplicates of map[apphost:app1 name:myapp], keeping the newest one\n")
+	all, err := store.ListBinds(context.Background(), "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(all, check.HasLen, 2)
+	bind, err := store.GetBind(context.Background(), "myapp", "app1", readWriteBind)
+	c.Assert(err, check.IsNil)
+	c.Assert(bind.User, check.Equals, "myappfedcba98")
+	c.Assert(store.AddBind(context.Background(), dbBind{Name: "myapp", AppHost: "app1"}), check.Equals, errAlreadyBound)
+}
+
+func (s *S) TestNewStore(c *check.C) {
+	conf := &config{Clusters: []clusterConfig{{Name: "main", URI: "mongo1:27017"}, {Name: "big"}}}
+	conf.Metadata.Store = "mongodb"
+	store, err := newStore(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.FitsTypeOf, &mongoStore{})
+	c.Assert(store.(*mongoStore).cluster.Name, check.Equals, "main")
+	conf.Metadata = metadataConfig{Store: "bolt", Path: filepath.Join(c.MkDir(), "mongoapi.db")}
+	store, err = newStore(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.FitsTypeOf, &boltStore{})
+	store.Close()
+	conf.Metadata = metadataConfig{Store: "unknown"}
+	store, err = newStore(conf)
+	c.Assert(store, check.IsNil)
+	c.Assert(err, check.ErrorMatches, `unknown store "unknown"`)
+}
+
+func (s *S) TestNewBoltStoreInUse(c *check.C) {
+	path := filepath.Join(c.MkDir(), "mongoapi.db")
+	store, err := newBoltStore(path)
+	c.Assert(err, check.IsNil)
+	defer store.Close()
+	_, err = newBoltStore(path)
+	c.Assert(err, check.ErrorMatches, `.*mongoapi.db is in use by another process, like the API: the bolt store can't be shared`)
+}
+
+func (s *S) TestStoreInstances(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreInstances(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreInstances(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreInstances(c, store)
+	}
+}
+
+func testStoreInstances(c *check.C, store Store) {
+	err := store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "small", Database: "myapp_1", Team: "myteam"})
+	c.Check(err, check.IsNil)
+	err = store.AddInstance(context.Background(), dbInstance{Name: "another"})
+	c.Check(err, check.IsNil)
+	err = store.AddInstance(context.Background(), dbInstance{Name: "myapp", Plan: "large"})
+	c.Check(err, check.Equals, errInstanceExists)
+	err = store.AddInstance(context.Background(), dbInstance{Name: "myapp.1", Database: "MyApp_1"})
+	c.Check(err, check.Equals, errDatabaseInUse)
+	err = store.AddInstance(context.Background(), dbInstance{Name: "other", Cluster: "big", Database: "myapp_1"})
+	c.Check(err, check.IsNil)
+	instance, err := store.GetInstance(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(instance, check.DeepEquals, dbInstance{Name: "myapp", Plan: "small", Database: "myapp_1", Team: "myteam"})
+	instances, err := store.ListInstances(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(instances, check.HasLen, 3)
+	c.Check(store.RemoveInstance(context.Background(), "myapp"), check.IsNil)
+	_, err = store.GetInstance(context.Background(), "myapp")
+	c.Check(err, check.Equals, errNotFound)
+	c.Check(store.RemoveInstance(context.Background(), "myapp"), check.Equals, errNotFound)
+	store.Close()
+}
+
+func (s *S) TestStoreBinds(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreBinds(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreBinds(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreBinds(c, store)
+	}
+}
+
+func testStoreBinds(c *check.C, store Store) {
+	first := dbBind{Name: "myapp", AppHost: "app1.tsuru.io", User: "user1", Password: "123"}
+	second := dbBind{Name: "myapp", AppHost: "app2.tsuru.io", User: "user2", Password: "456"}
+	other := dbBind{Name: "myapp2", AppHost: "app1.tsuru.io", User: "user3", Password: "789"}
+	reader := dbBind{Name: "myapp", AppHost: "app2.tsuru.io", User: "user4", Password: "000", Kind: readBind, EnvPrefix: "BI"}
+	for _, b := range []dbBind{first, second, other, reader} {
+		c.Check(store.AddBind(context.Background(), b), check.IsNil)
+	}
+	duplicate := dbBind{Name: "myapp", AppHost: "app1.tsuru.io", User: "user5", Password: "111"}
+	c.Check(store.AddBind(context.Background(), duplicate), check.Equals, errAlreadyBound)
+	bind, err := store.GetBind(context.Background(), "myapp", "app2.tsuru.io", readWriteBind)
+	c.Check(err, check.IsNil)
+	c.Check(bind, check.DeepEquals, second)
+	bind, err = store.GetBind(context.Background(), "myapp", "app2.tsuru.io", readBind)
+	c.Check(err, check.IsNil)
+	c.Check(bind, check.DeepEquals, reader)
+	_, err = store.GetBind(context.Background(), "myapp", "app1.tsuru.io", readBind)
+	c.Check(err, check.Equals, errNotFound)
+	binds, err := store.ListBinds(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(binds, check.DeepEquals, []dbBind{first, second, reader})
+	binds, err = store.ListAllBinds(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(binds, check.HasLen, 4)
+	c.Check(store.RemoveBind(context.Background(), first), check.IsNil)
+	_, err = store.GetBind(context.Background(), "myapp", "app1.tsuru.io", readWriteBind)
+	c.Check(err, check.Equals, errNotFound)
+	c.Check(store.RemoveBinds(context.Background(), "myapp2"), check.IsNil)
+	binds, err = store.ListBinds(context.Background(), "myapp2")
+	c.Check(err, check.IsNil)
+	c.Check(binds, check.HasLen, 0)
+	binds, err = store.ListBinds(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(binds, check.DeepEquals, []dbBind{second, reader})
+	store.RemoveBinds(context.Background(), "myapp")
+	store.Close()
+}
+
+func (s *S) TestStoreAuditEntries(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreAuditEntries(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreAuditEntries(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreAuditEntries(c, store)
+	}
+}
+
+func testStoreAuditEntries(c *check.C, store Store) {
+	c.Check(store.AddAuditEntry(context.Background(), auditEntry{Instance: "myapp", Action: "add"}), check.IsNil)
+	c.Check(store.AddAuditEntry(context.Background(), auditEntry{Instance: "other", Action: "add"}), check.IsNil)
+	c.Check(store.AddAuditEntry(context.Background(), auditEntry{Instance: "myapp", Action: "bind", AppHost: "localhost"}), check.IsNil)
+	entries, err := store.ListAuditEntries(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(entries, check.DeepEquals, []auditEntry{
+		{Instance: "myapp", Action: "add"},
+		{Instance: "myapp", Action: "bind", AppHost: "localhost"},
+	})
+	store.Close()
+}
+
+func (s *S) TestStoreLocks(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreLocks(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreLocks(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreLocks(c, store)
+	}
+}
+
+func testStoreLocks(c *check.C, store Store) {
+	acquired, err := store.Lock(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(acquired, check.Equals, true)
+	acquired, err = store.Lock(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(acquired, check.Equals, false)
+	acquired, err = store.Lock(context.Background(), "other")
+	c.Check(err, check.IsNil)
+	c.Check(acquired, check.Equals, true)
+	c.Check(store.Unlock(context.Background(), "myapp"), check.IsNil)
+	acquired, err = store.Lock(context.Background(), "myapp")
+	c.Check(err, check.IsNil)
+	c.Check(acquired, check.Equals, true)
+	store.Unlock(context.Background(), "myapp")
+	store.Unlock(context.Background(), "other")
+	store.Close()
+}
+
+func (s *S) TestStoreRevocations(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreRevocations(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreRevocations(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreRevocations(c, store)
+	}
+}
+
+func (s *S) TestStoreMigrations(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreMigrations(c, store)
+	}
+}
+
+func (s *MongoSuite) TestStoreMigrations(c *check.C) {
+	for _, store := range s.stores(c) {
+		testStoreMigrations(c, store)
+	}
+}
+
+func testStoreMigrations(c *check.C, store Store) {
+	applied := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	c.Check(store.AddMigration(context.Background(), dbMigration{Version: 2, Name: "second", Time: applied}), check.IsNil)
+	c.Check(store.AddMigration(context.Background(), dbMigration{Version: 1, Name: "first", Time: applied}), check.IsNil)
+	migrations, err := store.ListMigrations(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(migrations, check.HasLen, 2)
+	for i, name := range []string{"first", "second"} {
+		c.Check(migrations[i].Version, check.Equals, i+1)
+		c.Check(migrations[i].Name, check.Equals, name)
+		c.Check(migrations[i].Time.Equal(applied), check.Equals, true)
+	}
+	store.Close()
+}
+
+func testStoreRevocations(c *check.C, store Store) {
+	first := dbRevocation{Cluster: "main", Serial: "1f", Time: time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)}
+	second := dbRevocation{Cluster: "main", Serial: "2a", Time: time.Date(2015, 6, 2, 10, 0, 0, 0, time.UTC)}
+	other := dbRevocation{Cluster: "big", Serial: "3b", Time: time.Date(2015, 6, 3, 10, 0, 0, 0, time.UTC)}
+	// revoking a certificate again is ignored.
+	for _, r := range []dbRevocation{first, second, other, first} {
+		c.Check(store.AddRevocation(context.Background(), r), check.IsNil)
+	}
+	revocations, err := store.ListRevocations(context.Background(), "main")
+	c.Check(err, check.IsNil)
+	c.Check(revocations, check.HasLen, 2)
+	for i, r := range []dbRevocation{first, second} {
+		c.Check(revocations[i].Serial, check.Equals, r.Serial)
+		c.Check(revocations[i].Time.Equal(r.Time), check.Equals, true)
+	}
+	revocations, err = store.ListRevocations(context.Background(), "unknown")
+	c.Check(err, check.IsNil)
+	c.Check(revocations, check.HasLen, 0)
+	store.Close()
+}
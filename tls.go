@@ -0,0 +1,133 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsLoader loads the certificates used by the API listener from disk, loading
+// them again whenever the files change, so they can be renewed without a
+// restart. The files come from the config in use, so they may also be changed
+// by reloading the config.
+type tlsLoader struct {
+	mut      sync.Mutex
+	cert     *tls.Certificate
+	certKey  string
+	clientCA *x509.CertPool
+	caKey    string
+}
+
+// fileKey identifies the contents of the given files by their paths and
+// modification times.
+func fileKey(paths ...string) string {
+	var key string
+	for _, path := range paths {
+		var mod time.Time
+		if info, err := os.Stat(path); err == nil {
+			mod = info.ModTime()
+		}
+		key += fmt.Sprintf("%s@%d;", path, mod.UnixNano())
+	}
+	return key
+}
+
+// certificate returns the API certificate, loading it again when the files
+// changed. When they can't be loaded, as while they're being renewed, the
+// last certificate loaded is kept until they change again.
+func (l *tlsLoader) certificate(c tlsConfig) (*tls.Certificate, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	key := fileKey(c.CertFile, c.KeyFile)
+	if l.cert == nil || key != l.certKey {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			err = fmt.Errorf("failed to load the API certificate: %s", err)
+			if l.cert == nil {
+				return nil, err
+			}
+			log.Printf("%s, keeping the current one", err)
+			l.certKey = key
+			return l.cert, nil
+		}
+		l.cert, l.certKey = &cert, key
+	}
+	return l.cert, nil
+}
+
+// clientCAs returns the client CA, loading it again when the file changed,
+// and keeping the last one loaded when it can't be loaded.
+func (l *tlsLoader) clientCAs(c tlsConfig) (*x509.CertPool, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	key := fileKey(c.ClientCAFile)
+	if l.clientCA == nil || key != l.caKey {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			err = fmt.Errorf("failed to load the client CA: %s", err)
+			if l.clientCA == nil {
+				return nil, err
+			}
+			log.Printf("%s, keeping the current one", err)
+			l.caKey = key
+			return l.clientCA, nil
+		}
+		l.clientCA, l.caKey = pool, key
+	}
+	return l.clientCA, nil
+}
+
+// config returns the TLS config for the current config, requiring client
+// certificates when a client CA is configured.
+func (l *tlsLoader) config() (*tls.Config, error) {
+	c := currentConfig().TLS
+	cert, err := l.certificate(c)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		conf.ClientCAs, err = l.clientCAs(c)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// serverTLSConfig returns the TLS config of the API listener. The
+// certificates are loaded on every handshake, so the config must be valid
+// before calling it.
+func serverTLSConfig(l *tlsLoader) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.config()
+		},
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// testCA is a certificate authority used to issue certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(c *check.C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mongoapi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, check.IsNil)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a certificate and key, in PEM, for the given common name.
+func (ca *testCA) issue(c *check.C, cn string, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, check.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// writeFiles writes each content in a file in dir, with the given modification
+// time.
+func writeFiles(c *check.C, dir string, mod time.Time, contents map[string][]byte) {
+	for name, content := range contents {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, content, 0600)
+		c.Assert(err, check.IsNil)
+		err = os.Chtimes(path, mod, mod)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+// startTLSServer starts a server with the API TLS config, and returns a
+// client that trusts the given CA.
+func (s *S) startTLSServer(c *check.C, ca *testCA) (*httptest.Server, *http.Client) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = serverTLSConfig(&tlsLoader{})
+	server.StartTLS()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		DisableKeepAlives: true,
+	}}
+	return server, client
+}
+
+func (s *S) TestServerTLSConfigReloadsCertificate(c *check.C) {
+	ca := newTestCA(c)
+	dir := c.MkDir()
+	cert, key := ca.issue(c, "mongoapi.example.com", 10)
+	writeFiles(c, dir, time.Now().Add(-time.Minute), map[string][]byte{"cert.pem": cert, "key.pem": key})
+	s.conf.TLS = tlsConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	server, client := s.startTLSServer(c, ca)
+	defer server.Close()
+	resp, err := client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNoContent)
+	c.Assert(resp.TLS.PeerCertificates[0].SerialNumber.Int64(), check.Equals, int64(10))
+	cert, key = ca.issue(c, "mongoapi.example.com", 11)
+	writeFiles(c, dir, time.Now(), map[string][]byte{"cert.pem": cert, "key.pem": key})
+	resp, err = client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.TLS.PeerCertificates[0].SerialNumber.Int64(), check.Equals, int64(11))
+}
+
+func (s *S) TestServerTLSConfigKeepsCertificateOnLoadFailure(c *check.C) {
+	ca := newTestCA(c)
+	dir := c.MkDir()
+	cert, key := ca.issue(c, "mongoapi.example.com", 10)
+	writeFiles(c, dir, time.Now().Add(-2*time.Minute), map[string][]byte{"cert.pem": cert, "key.pem": key})
+	s.conf.TLS = tlsConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	server, client := s.startTLSServer(c, ca)
+	defer server.Close()
+	resp, err := client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	cert, newKey := ca.issue(c, "mongoapi.example.com", 11)
+	writeFiles(c, dir, time.Now().Add(-time.Minute), map[string][]byte{"cert.pem": cert})
+	resp, err = client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.TLS.PeerCertificates[0].SerialNumber.Int64(), check.Equals, int64(10))
+	writeFiles(c, dir, time.Now(), map[string][]byte{"key.pem": newKey})
+	resp, err = client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.TLS.PeerCertificates[0].SerialNumber.Int64(), check.Equals, int64(11))
+}
+
+func (s *S) TestServerTLSConfigClientCertificate(c *check.C) {
+	ca := newTestCA(c)
+	dir := c.MkDir()
+	cert, key := ca.issue(c, "mongoapi.example.com", 10)
+	writeFiles(c, dir, time.Now(), map[string][]byte{"cert.pem": cert, "key.pem": key, "ca.pem": ca.pem})
+	s.conf.TLS = tlsConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	server, client := s.startTLSServer(c, ca)
+	defer server.Close()
+	_, err := client.Get(server.URL)
+	c.Assert(err, check.NotNil)
+	clientCert, clientKey := ca.issue(c, "tsuru", 20)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	c.Assert(err, check.IsNil)
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{pair}
+	resp, err := client.Get(server.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusNoContent)
+	other := newTestCA(c)
+	clientCert, clientKey = other.issue(c, "tsuru", 20)
+	pair, err = tls.X509KeyPair(clientCert, clientKey)
+	c.Assert(err, check.IsNil)
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{pair}
+	_, err = client.Get(server.URL)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestTLSLoaderInvalidCertificate(c *check.C) {
+	s.conf.TLS = tlsConfig{CertFile: "/does/not/exist.pem", KeyFile: "/does/not/exist.pem"}
+	_, err := (&tlsLoader{}).config()
+	c.Assert(err, check.ErrorMatches, "failed to load the API certificate: .*")
+}
+
+func (s *S) TestTLSLoaderInvalidClientCA(c *check.C) {
+	ca := newTestCA(c)
+	dir := c.MkDir()
+	cert, key := ca.issue(c, "mongoapi.example.com", 10)
+	writeFiles(c, dir, time.Now(), map[string][]byte{"cert.pem": cert, "key.pem": key, "ca.pem": []byte("not a cert")})
+	s.conf.TLS = tlsConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	_, err := (&tlsLoader{}).config()
+	c.Assert(err, check.ErrorMatches, "failed to load the client CA: no certificates found in .*")
+}
+
+func (s *S) TestApplyFlags(c *check.C) {
+	defer func() { listen, tlsCert, tlsKey, tlsClientCA = "", "", "", "" }()
+	listen, tlsCert, tlsKey, tlsClientCA = "127.0.0.1:8443", "cert.pem", "key.pem", "ca.pem"
+	conf := &config{Metadata: metadataConfig{Store: "mongodb"}}
+	err := applyFlags(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Listen, check.Equals, "127.0.0.1:8443")
+	c.Assert(conf.TLS, check.Equals, tlsConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem"})
+	tlsCert, tlsKey = "", "key.pem"
+	err = applyFlags(conf)
+	c.Assert(err, check.ErrorMatches, "invalid config: tls: cert-file and key-file must be set together")
+}
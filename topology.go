@@ -0,0 +1,55 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// topology describes the members of a cluster, as seen by the apps.
+type topology struct {
+	ReplicaSet string
+	Hosts      []string
+}
+
+// clusterTopology returns the topology handed out to apps bound to instances
+// in the cluster. When discovery is enabled, the replica set and its members
+// come from the cluster itself, and the hosts are translated with the host
+// map. Otherwise, or when the cluster isn't a replica set, they come from the
+// config.
+func clusterTopology(ctx context.Context, cluster clusterConfig) (topology, error) {
+	static := topology{ReplicaSet: cluster.ReplicaSet, Hosts: strings.Split(cluster.PublicURI, ",")}
+	if !cluster.Discover {
+		return static, nil
+	}
+	discovered, err := newCluster(cluster).Topology(ctx)
+	if err != nil {
+		return topology{}, err
+	}
+	if discovered.ReplicaSet == "" || len(discovered.Hosts) == 0 {
+		return static, nil
+	}
+	hosts := make([]string, len(discovered.Hosts))
+	for i, host := range discovered.Hosts {
+		hosts[i] = cluster.publicHost(host)
+	}
+	return topology{ReplicaSet: discovered.ReplicaSet, Hosts: hosts}, nil
+}
+
+// publicHost translates the given host, as known inside the cluster, to the
+// host used by apps. The host map may have the host with or without the port.
+func (c clusterConfig) publicHost(host string) string {
+	if public, ok := c.HostMap[host]; ok {
+		return public
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if public, ok := c.HostMap[h]; ok {
+			return net.JoinHostPort(public, port)
+		}
+	}
+	return host
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 mongoapi authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestClusterTopologyFromConfig(c *check.C) {
+	s.cluster.members = topology{ReplicaSet: "rs0", Hosts: []string{"mongo1.internal:27017"}}
+	topo, err := clusterTopology(context.Background(), clusterConfig{PublicURI: "mongo1.example.com:27017,mongo2.example.com:27017", ReplicaSet: "tsuru"})
+	c.Assert(err, check.IsNil)
+	c.Assert(topo, check.DeepEquals, topology{
+		ReplicaSet: "tsuru",
+		Hosts:      []string{"mongo1.example.com:27017", "mongo2.example.com:27017"},
+	})
+}
+
+func (s *S) TestClusterTopologyDiscovered(c *check.C) {
+	s.cluster.members = topology{
+		ReplicaSet: "rs0",
+		Hosts:      []string{"mongo1.internal:27017", "mongo2.internal:27018", "mongo3.internal:27017"},
+	}
+	topo, err := clusterTopology(context.Background(), clusterConfig{
+		PublicURI: "mongo1.example.com:27017",
+		Discover:  true,
+		HostMap: map[string]string{
+			"mongo1.internal:27017": "mongo1.example.com:27017",
+			"mongo2.internal":       "mongo2.example.com",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(topo, check.DeepEquals, topology{
+		ReplicaSet: "rs0",
+		Hosts:      []string{"mongo1.example.com:27017", "mongo2.example.com:27018", "mongo3.internal:27017"},
+	})
+}
+
+func (s *S) TestClusterTopologyStandalone(c *check.C) {
+	topo, err := clusterTopology(context.Background(), clusterConfig{PublicURI: "mongo.example.com:27017", Discover: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(topo, check.DeepEquals, topology{Hosts: []string{"mongo.example.com:27017"}})
+}
+
+func (s *S) TestClusterTopologyFailure(c *check.C) {
+	s.cluster.fail("Topology", errors.New("no reachable servers"))
+	_, err := clusterTopology(context.Background(), clusterConfig{PublicURI: "mongo.example.com:27017", Discover: true})
+	c.Assert(err, check.ErrorMatches, "no reachable servers")
+	_, err = clusterTopology(context.Background(), clusterConfig{PublicURI: "mongo.example.com:27017"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestBindWithDiscovery(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.members = topology{ReplicaSet: "rs0", Hosts: []string{"mongo1.internal:27017", "mongo2.internal:27017"}}
+	s.conf.Clusters[0].Discover = true
+	s.conf.Clusters[0].HostMap = map[string]string{"mongo1.internal": "mongo1.example.com", "mongo2.internal": "mongo2.example.com"}
+	env, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(env["MONGODB_HOSTS"], check.Equals, "mongo1.example.com:27017,mongo2.example.com:27017")
+	c.Assert(env["MONGODB_REPLICA_SET"], check.Equals, "rs0")
+	conn, err := parseConnString(env["MONGODB_CONNECTION_STRING"])
+	c.Assert(err, check.IsNil)
+	c.Assert(conn.Hosts, check.DeepEquals, []string{"mongo1.example.com:27017", "mongo2.example.com:27017"})
+	c.Assert(conn.get("replicaSet"), check.Equals, "rs0")
+}
+
+func (s *S) TestBindWithDiscoveryFailure(c *check.C) {
+	s.store.AddInstance(context.Background(), dbInstance{Name: "myapp"})
+	s.cluster.fail("Topology", errors.New("no reachable servers"))
+	s.conf.Clusters[0].Discover = true
+	_, err := bind(context.Background(), "myapp", "localhost", bindOptions{})
+	c.Assert(err, check.ErrorMatches, "no reachable servers")
+	c.Assert(s.cluster.users, check.HasLen, 0)
+}
+
+func (s *S) TestSeedlistWithDiscovery(c *check.C) {
+	s.cluster.members = topology{ReplicaSet: "rs0", Hosts: []string{"mongo1.internal:27017"}}
+	server, resolver := s.startSeedlist(c, clusterConfig{
+		Name:      "default",
+		PublicURI: "mongo1.db.example.com",
+		Seedlist:  "main.db.example.com",
+		Discover:  true,
+		HostMap:   map[string]string{"mongo1.internal": "mongo1.db.example.com"},
+	})
+	defer server.Close()
+	_, addrs, err := resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(addrs, check.DeepEquals, []*net.SRV{{Target: "mongo1.db.example.com.", Port: 27017}})
+	s.cluster.fail("Topology", errors.New("no reachable servers"))
+	_, _, err = resolver.LookupSRV(context.Background(), "mongodb", "tcp", "main.db.example.com")
+	c.Assert(err, check.NotNil)
+	c.Assert(err.(*net.DNSError).IsNotFound, check.Equals, false)
+}